@@ -0,0 +1,78 @@
+package sharpei
+
+import (
+	"math"
+
+	"github.com/meownoid/sharpei/vips"
+)
+
+// bandConstants returns constants for every band of the image, LAB bands take values from lab,
+// extra bands (alpha) take the rest value
+func bandConstants(img *vips.Image, lab [3]float64, rest float64) []float64 {
+	result := make([]float64, img.Bands())
+
+	for i := range result {
+		if i < len(lab) {
+			result[i] = lab[i]
+		} else {
+			result[i] = rest
+		}
+	}
+
+	return result
+}
+
+// adjustImage applies tonal and colour adjustments to the image in the LAB PCS space
+func adjustImage(img *vips.Image, cfg AdjustConfig) (*vips.Image, error) {
+	result, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lightness is scaled by the linear transformation below
+	lightness := 1.0
+
+	if cfg.Gamma > 0 && cfg.Gamma != 1 {
+		// L' = 100 * (L / 100) ^ (1 / gamma)
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return img.Linear(
+				bandConstants(img, [3]float64{0.01, 1, 1}, 1),
+				bandConstants(img, [3]float64{0, 0, 0}, 0),
+			)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return img.PowConst(bandConstants(img, [3]float64{1 / cfg.Gamma, 1, 1}, 1))
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		lightness = 100
+	}
+
+	// Contrast stretches lightness around the middle grey, brightness shifts it
+	contrast := math.Max(1+cfg.Contrast, 0)
+	offset := 50*(1-contrast) + 100*cfg.Brightness
+
+	// Saturation scales chroma, a and b components
+	chroma := math.Max(1+cfg.Saturation, 0)
+	if cfg.Grayscale {
+		chroma = 0
+	}
+
+	result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+		return img.Linear(
+			bandConstants(img, [3]float64{lightness * contrast, chroma, chroma}, 1),
+			bandConstants(img, [3]float64{offset, 0, 0}, 0),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
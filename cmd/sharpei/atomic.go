@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// atomicTempPrefix is the prefix of temporary files which are renamed to outputs when they are complete
+const atomicTempPrefix = ".sharpei-tmp-"
+
+// Temporary files which are being written, they are removed on interrupt.
+// Files are created and renamed holding the lock, so interrupt can not happen in the middle of it.
+var (
+	tempFilesMu sync.Mutex
+	tempFiles   = map[string]bool{}
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory, syncs it and renames it to path,
+// so path has either the old content or the whole new one. Permissions of the existing file are preserved.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if stat, err := os.Stat(path); err == nil {
+		perm = stat.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+
+	// File is created and registered holding the lock, so interrupt can not leave it unregistered
+	tempFilesMu.Lock()
+	f, err := ioutil.TempFile(dir, atomicTempPrefix)
+	if err == nil {
+		tempFiles[f.Name()] = true
+	}
+	tempFilesMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tempPath := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, perm)
+	}
+
+	tempFilesMu.Lock()
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	delete(tempFiles, tempPath)
+	tempFilesMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Rename is durable only when the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
+
+// removeTempFiles removes temporary files of unfinished writes, no files can be renamed after that
+func removeTempFiles() {
+	// Lock is never released
+	tempFilesMu.Lock()
+
+	for path := range tempFiles {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	col "github.com/fatih/color"
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+// writeOutput formats filename of the output and writes it to the output directory,
+// rendition is returned if the output file exists after that, event tells whether it was written
+func writeOutput(cfg *sharpei.Config, src *sourceInfo, profileName string, out *sharpei.Rendition) (*rendition, event) {
+	imagePath := src.path
+
+	format := cfg.Format
+	// Every width of the ladder needs a distinct filename
+	if out.Rung > 0 && !strings.Contains(format, "{width}") {
+		format += "_{width}"
+	}
+
+	filename, err := formatFilename(format, profileName, src, out)
+	if err != nil {
+		return nil, failedEvent(imagePath, profileName, "", errors.Wrap(err, "error in format string"))
+	}
+
+	filename = fmt.Sprintf("%s.%s", filename, out.Format)
+
+	outputPath, err := layoutPath(cfg, src, profileName, filename)
+	if err != nil {
+		return nil, failedEvent(imagePath, profileName, "", err)
+	}
+
+	// Filename can contain subdirectories
+	outputDir := filepath.Dir(outputPath)
+
+	// Symbolic links can lead outside of the output directory as well,
+	// so the path is checked before any directory is created
+	if err := checkResolvedPath(cfg.Output, outputDir); err != nil {
+		return nil, failedEvent(imagePath, profileName, outputPath, err)
+	}
+
+	stat, err := os.Stat(outputDir)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(outputDir, 0755)
+		}
+		if err != nil {
+			return nil, failedEvent(imagePath, profileName, outputPath, err)
+		}
+	} else if !stat.IsDir() {
+		return nil, failedEvent(imagePath, profileName, outputPath, errors.Errorf("%s exists and not a directory, skipping", outputDir))
+	}
+
+	result := &rendition{
+		Path:    outputPath,
+		Profile: profileName,
+		Format:  out.Format,
+		Width:   out.Width,
+		Height:  out.Height,
+		Bytes:   int64(len(out.Data)),
+		Hash:    out.Hash,
+	}
+
+	ev := event{
+		Type:    eventOutput,
+		Source:  imagePath,
+		Profile: profileName,
+		Output:  outputPath,
+		Width:   out.Width,
+		Height:  out.Height,
+	}
+
+	// Stale outputs are always rewritten in incremental mode
+	if stat, err := os.Stat(outputPath); err == nil && !cfg.Rewrite && !cfg.Incremental {
+		// Existing file may differ from the rendered one
+		hash, err := fileHash(outputPath)
+		if err != nil {
+			return nil, failedEvent(imagePath, profileName, outputPath, err)
+		}
+
+		result.Bytes = stat.Size()
+		result.Hash = hash
+
+		ev.Status = statusSkipped
+		ev.Reason = reasonExists
+		ev.Bytes = result.Bytes
+
+		return result, ev
+	}
+
+	// Output is either complete or not written at all, even if the process is interrupted
+	if err := writeFileAtomic(outputPath, out.Data, 0644); err != nil {
+		return nil, failedEvent(imagePath, profileName, outputPath, err)
+	}
+
+	ev.Status = statusWritten
+	ev.Bytes = result.Bytes
+
+	return result, ev
+}
+
+// processImage runs every profile of the config on the image with the processor of the config and writes outputs,
+// in incremental mode profiles with fresh outputs are skipped. Processing is aborted when ctx is cancelled.
+func processImage(ctx context.Context, proc *sharpei.Processor, cfg *sharpei.Config, cache *buildCache, input inputFile, rep *reporter) manifestSource {
+	imagePath := input.path
+	rep.sum.images++
+
+	start := time.Now()
+
+	// failed reports failure of the source with the time spent on it until the failure
+	failed := func(err error) {
+		ev := failedEvent(imagePath, "", "", err)
+		ev.DurationMS = time.Since(start).Milliseconds()
+		rep.report(ev)
+	}
+
+	source := manifestSource{
+		Source:  imagePath,
+		Outputs: []rendition{},
+	}
+
+	// In incremental mode only profiles with stale outputs are processed
+	var state *sourceState
+	stale := make(map[string]bool, len(cfg.Profiles))
+
+	if cache != nil {
+		var err error
+		state, err = newSourceState(imagePath)
+		if err != nil {
+			failed(err)
+			return source
+		}
+
+		for profileName, profile := range cfg.Profiles {
+			key := cacheKey(imagePath, profileName)
+
+			if !cache.isFresh(key, state, profileHash(cfg, profile)) {
+				stale[profileName] = true
+				continue
+			}
+
+			for _, r := range cache.Entries[key].Outputs {
+				source.Outputs = append(source.Outputs, r)
+
+				rep.report(event{
+					Type:    eventOutput,
+					Source:  imagePath,
+					Profile: profileName,
+					Output:  r.Path,
+					Status:  statusSkipped,
+					Reason:  reasonUpToDate,
+					Width:   r.Width,
+					Height:  r.Height,
+					Bytes:   r.Bytes,
+				})
+			}
+		}
+
+		if len(stale) == 0 {
+			return source
+		}
+	}
+
+	// Only stale profiles are processed in incremental mode, all of them otherwise
+	var names []string
+	for profileName := range stale {
+		names = append(names, profileName)
+	}
+
+	var src *sourceInfo
+	wroteAny := false
+
+	// Profiles share the decoded image, colour import and resized intermediates
+	err := proc.ProcessFileFunc(ctx, imagePath, names, func(img *sharpei.Image, profileName string, out sharpei.Output, err error) error {
+		if err != nil {
+			rep.report(failedEvent(imagePath, profileName, "", err))
+			return nil
+		}
+
+		if src == nil {
+			src = newSourceInfo(imagePath, input.root, img)
+		}
+
+		existing := make([]rendition, 0, len(out.Renditions))
+
+		for i := range out.Renditions {
+			writeStart := time.Now()
+
+			r, ev := writeOutput(cfg, src, profileName, &out.Renditions[i])
+			ev.DurationMS = (out.Renditions[i].Duration + time.Since(writeStart)).Milliseconds()
+			rep.report(ev)
+
+			if r == nil {
+				continue
+			}
+
+			existing = append(existing, *r)
+
+			if ev.Status == statusWritten {
+				wroteAny = true
+			}
+		}
+
+		source.Outputs = append(source.Outputs, existing...)
+
+		// Profile stays stale if any of the outputs failed
+		if cache != nil && len(existing) == len(out.Renditions) {
+			hash := profileHash(cfg, cfg.Profiles[profileName])
+
+			if err := cache.update(cacheKey(imagePath, profileName), state, hash, existing); err != nil {
+				fmt.Fprintf(messages, "%s: %s\n", imagePath, col.RedString(err.Error()))
+			}
+		}
+
+		return nil
+	})
+
+	switch {
+	case ctx.Err() != nil:
+		rep.sum.images--
+		rep.report(event{Type: eventOutput, Source: imagePath, Status: statusInterrupted})
+	case err != nil:
+		failed(err)
+	}
+
+	if wroteAny {
+		if stat, err := os.Stat(imagePath); err == nil {
+			rep.sum.inputBytes += stat.Size()
+		}
+	}
+
+	return source
+}
+
+// filterImages returns only inputs which are images
+func filterImages(inputs []inputFile, rep *reporter) []inputFile {
+	result := make([]inputFile, 0, len(inputs))
+
+	for _, input := range inputs {
+		if !sharpei.IsImage(input.path) {
+			rep.report(event{Type: eventOutput, Source: input.path, Status: statusSkipped, Reason: reasonNotAnImage})
+			continue
+		}
+
+		result = append(result, input)
+	}
+
+	return result
+}
+
+// openCache loads cache of the incremental mode, nil is returned if incremental mode is disabled
+func openCache(cfg *sharpei.Config) *buildCache {
+	if !cfg.Incremental {
+		return nil
+	}
+
+	path := cacheFilePath(cfg)
+
+	cache, err := loadCache(path)
+	if err != nil {
+		fmt.Fprintf(messages, "%s: %s\n", path, col.RedString(err.Error()+", rebuilding everything"))
+		cache = newBuildCache()
+	}
+
+	return cache
+}
+
+func saveCache(cfg *sharpei.Config, cache *buildCache) {
+	if cache == nil {
+		return
+	}
+
+	path := cacheFilePath(cfg)
+
+	if err := cache.save(path); err != nil {
+		fmt.Fprintf(messages, "%s: %s\n", path, col.RedString(err.Error()))
+	}
+}
+
+// writeReports writes manifest and HTML snippets if their paths are set
+func writeReports(manifestPath string, htmlPath string, htmlSizes string, sources []manifestSource) {
+	if manifestPath != "" {
+		if err := writeManifest(manifestPath, sources); err != nil {
+			fmt.Fprintf(messages, "%s: %s\n", manifestPath, col.RedString(err.Error()))
+		} else {
+			fmt.Fprintf(messages, "%s: %s\n", manifestPath, col.GreenString("OK"))
+		}
+	}
+
+	if htmlPath != "" {
+		if err := writeHTML(htmlPath, htmlSizes, sources); err != nil {
+			fmt.Fprintf(messages, "%s: %s\n", htmlPath, col.RedString(err.Error()))
+		} else {
+			fmt.Fprintf(messages, "%s: %s\n", htmlPath, col.GreenString("OK"))
+		}
+	}
+}
+
+type batchOptions struct {
+	failFast bool
+	strict   bool
+
+	manifestPath string
+	htmlPath     string
+	htmlSizes    string
+}
+
+// runBatch processes the images and writes reports, exit code of the run is returned
+func runBatch(proc *sharpei.Processor, cfg *sharpei.Config, inputs []inputFile, rep *reporter, opts batchOptions) int {
+	if len(inputs) == 0 {
+		rep.finish(func() {
+			col.Green("No images to process")
+		})
+
+		if opts.strict {
+			return exitNothingToDo
+		}
+
+		return exitOK
+	}
+
+	defer sharpei.Shutdown()
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	cache := openCache(cfg)
+	defer saveCache(cfg, cache)
+
+	sources := make([]manifestSource, 0, len(inputs))
+	sum := &rep.sum
+
+	for i, input := range inputs {
+		// Outputs of finished images are kept, reports and cache are written for them
+		if ctx.Err() != nil {
+			sum.interrupted += len(inputs) - i
+			break
+		}
+
+		if opts.failFast && sum.failed > 0 {
+			sum.stoppedOnError += len(inputs) - i
+			break
+		}
+
+		source := processImage(ctx, proc, cfg, cache, input, rep)
+		if len(source.Outputs) > 0 {
+			sources = append(sources, source)
+		}
+	}
+
+	writeReports(opts.manifestPath, opts.htmlPath, opts.htmlSizes, sources)
+	rep.finish(sum.print)
+
+	return sum.exitCode(opts.strict)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/meownoid/sharpei"
+)
+
+const cacheVersion = 1
+
+// sourceSignature identifies content of the source file, content hash is compared
+// only if size or modification time has changed
+type sourceSignature struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+type cacheEntry struct {
+	Source  sourceSignature `json:"source"`
+	Profile string          `json:"profile"`
+	Outputs []rendition     `json:"outputs"`
+}
+
+// buildCache records which outputs were generated from which version of the source and profile
+type buildCache struct {
+	Version int                    `json:"version"`
+	Entries map[string]*cacheEntry `json:"entries"`
+}
+
+// cacheFilePath returns path of the cache, by default it is stored in the output directory
+func cacheFilePath(cfg *sharpei.Config) string {
+	if cfg.Cache != "" {
+		return cfg.Cache
+	}
+
+	return filepath.Join(cfg.Output, ".sharpei-cache.json")
+}
+
+func newBuildCache() *buildCache {
+	return &buildCache{
+		Version: cacheVersion,
+		Entries: map[string]*cacheEntry{},
+	}
+}
+
+func loadCache(path string) (*buildCache, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newBuildCache(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded buildCache
+	if err := json.Unmarshal(content, &loaded); err != nil {
+		return nil, err
+	}
+
+	// Cache of other version is discarded and everything is rebuilt
+	if loaded.Version != cacheVersion || loaded.Entries == nil {
+		return newBuildCache(), nil
+	}
+
+	return &loaded, nil
+}
+
+func (c *buildCache) save(path string) error {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, content, 0644)
+}
+
+func cacheKey(sourcePath string, profileName string) string {
+	if abs, err := filepath.Abs(sourcePath); err == nil {
+		sourcePath = abs
+	}
+
+	return sourcePath + "\x00" + profileName
+}
+
+// profileFiles returns size and modification time of the files the profile reads besides the source:
+// ICC profiles and the watermark image. Names of the built-in profiles are not files, so they are skipped.
+func profileFiles(profile sharpei.ProfileConfig) map[string]sourceSignature {
+	paths := []string{profile.InputProfile, profile.OutputProfile}
+	if profile.Watermark != nil {
+		paths = append(paths, profile.Watermark.Image)
+	}
+
+	files := map[string]sourceSignature{}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil || stat.IsDir() {
+			continue
+		}
+
+		files[path] = sourceSignature{
+			Size:    stat.Size(),
+			ModTime: stat.ModTime().UnixNano(),
+		}
+	}
+
+	return files
+}
+
+// profileHash returns hash of the effective profile configuration, including options
+// which affect output paths and files referenced by the profile
+func profileHash(cfg *sharpei.Config, profile sharpei.ProfileConfig) string {
+	content, _ := json.Marshal(struct {
+		Profile sharpei.ProfileConfig
+		Files   map[string]sourceSignature
+		Output  string
+		Format  string
+		Layout  string
+	}{
+		Profile: profile,
+		Files:   profileFiles(profile),
+		Output:  cfg.Output,
+		Format:  cfg.Format,
+		Layout:  cfg.Layout,
+	})
+
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// sourceState is the current state of the source file
+type sourceState struct {
+	path string
+	stat os.FileInfo
+	hash string
+}
+
+func newSourceState(path string) (*sourceState, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sourceState{
+		path: path,
+		stat: stat,
+	}, nil
+}
+
+// signature returns signature of the source, content hash is computed on the first call
+func (s *sourceState) signature() (sourceSignature, error) {
+	if s.hash == "" {
+		hash, err := fileHash(s.path)
+		if err != nil {
+			return sourceSignature{}, err
+		}
+
+		s.hash = hash
+	}
+
+	return sourceSignature{
+		Size:    s.stat.Size(),
+		ModTime: s.stat.ModTime().UnixNano(),
+		Hash:    s.hash,
+	}, nil
+}
+
+// isFresh returns true if outputs of the profile were generated from the same source
+// with the same profile configuration and all of them still exist
+func (c *buildCache) isFresh(key string, state *sourceState, profileHash string) bool {
+	entry, ok := c.Entries[key]
+	if !ok || entry.Profile != profileHash || len(entry.Outputs) == 0 {
+		return false
+	}
+
+	if entry.Source.Size != state.stat.Size() || entry.Source.ModTime != state.stat.ModTime().UnixNano() {
+		signature, err := state.signature()
+		if err != nil || signature.Hash != entry.Source.Hash {
+			return false
+		}
+
+		// Only modification time has changed, remember it to skip hashing next time
+		entry.Source = signature
+	}
+
+	for _, output := range entry.Outputs {
+		if _, err := os.Stat(output.Path); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *buildCache) update(key string, state *sourceState, profileHash string, outputs []rendition) error {
+	signature, err := state.signature()
+	if err != nil {
+		return err
+	}
+
+	c.Entries[key] = &cacheEntry{
+		Source:  signature,
+		Profile: profileHash,
+		Outputs: outputs,
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meownoid/sharpei"
+)
+
+func TestProfileHashReferencedFiles(t *testing.T) {
+	dir := tempDir(t)
+
+	logo := filepath.Join(dir, "logo.png")
+	writePNG(t, logo)
+
+	cfg := &sharpei.Config{Output: dir}
+	profile := sharpei.ProfileConfig{
+		Width:         32,
+		OutputProfile: "srgb",
+		Watermark:     &sharpei.WatermarkConfig{Image: logo},
+	}
+
+	before := profileHash(cfg, profile)
+
+	if again := profileHash(cfg, profile); again != before {
+		t.Fatal("hash of the same profile has changed")
+	}
+
+	// Same path, new content
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(logo, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := profileHash(cfg, profile); after == before {
+		t.Fatal("hash has not changed after the watermark image was modified")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meownoid/sharpei"
+)
+
+const diskCacheTempPrefix = ".sharpei-cache-tmp-"
+
+// isCacheName returns true if the file is named like the cache names its files, hex SHA-256 of the variant
+// with extension of the format. Other files of the directory are neither used nor removed.
+func isCacheName(name string) bool {
+	ext := filepath.Ext(name)
+	key := strings.TrimSuffix(name, ext)
+
+	if len(key) != 64 || !sharpei.IsImage(name) {
+		return false
+	}
+
+	for _, c := range key {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// diskCache is a size limited cache of files in the directory, least recently used files are removed first
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // Most recently used entry is at the front
+	entries map[string]*list.Element
+}
+
+// newDiskCache opens the cache directory, cached files which are already there are kept in order of their modification time
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// Leftovers of interrupted writes
+		if strings.HasPrefix(file.Name(), diskCacheTempPrefix) {
+			_ = os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		if !isCacheName(file.Name()) {
+			continue
+		}
+
+		c.entries[file.Name()] = c.order.PushFront(&diskCacheEntry{name: file.Name(), size: file.Size()})
+		c.size += file.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// open returns the cached file, nil is returned if there is no such file
+func (c *diskCache) open(name string) *os.File {
+	c.mu.Lock()
+	element, ok := c.entries[name]
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	path := filepath.Join(c.dir, name)
+
+	f, err := os.Open(path)
+	if err != nil {
+		c.mu.Lock()
+		c.remove(name)
+		c.mu.Unlock()
+		return nil
+	}
+
+	// Modification time keeps order of use between restarts
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return f
+}
+
+// put stores the file in the cache and removes least recently used files if the cache is full
+func (c *diskCache) put(name string, data []byte) error {
+	f, err := ioutil.TempFile(c.dir, diskCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.size -= element.Value.(*diskCacheEntry).size
+		c.order.Remove(element)
+	}
+
+	c.entries[name] = c.order.PushFront(&diskCacheEntry{name: name, size: int64(len(data))})
+	c.size += int64(len(data))
+
+	c.evict()
+
+	return nil
+}
+
+// remove removes the entry and its file, c.mu should be held
+func (c *diskCache) remove(name string) {
+	element, ok := c.entries[name]
+	if !ok {
+		return
+	}
+
+	entry := element.Value.(*diskCacheEntry)
+
+	c.order.Remove(element)
+	delete(c.entries, name)
+	c.size -= entry.size
+
+	_ = os.Remove(filepath.Join(c.dir, name))
+}
+
+// evict removes least recently used entries until the cache fits the limit, c.mu should be held
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Back().Value.(*diskCacheEntry).name)
+	}
+}
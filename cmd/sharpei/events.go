@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	col "github.com/fatih/color"
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+// Formats of the results printed to stdout
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+// Types of the events
+const (
+	eventOutput  = "output"
+	eventVerify  = "verify"
+	eventSummary = "summary"
+)
+
+// Statuses of the events
+const (
+	statusWritten     = "written"
+	statusSkipped     = "skipped"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+	statusRemoved     = "removed"
+	statusOK          = "ok"
+)
+
+// Reasons of the skipped events
+const (
+	reasonExists     = "exists"
+	reasonUpToDate   = "up_to_date"
+	reasonNotAnImage = "not_an_image"
+)
+
+// messages receives everything which is not an event, like progress of the watch mode.
+// In machine-readable formats it is stderr, so stdout contains only events.
+var messages io.Writer = os.Stdout
+
+// event is the result of a single output. Sources and profiles which fail before producing outputs
+// have an event without the output path.
+type event struct {
+	Type    string `json:"type"`
+	Source  string `json:"source"`
+	Profile string `json:"profile,omitempty"`
+	Output  string `json:"output,omitempty"`
+	Status  string `json:"status"`
+	// Why the output was skipped
+	Reason string `json:"reason,omitempty"`
+
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	Width  int   `json:"width,omitempty"`
+	Height int   `json:"height,omitempty"`
+	Bytes  int64 `json:"bytes,omitempty"`
+	// Time spent on the output: resizing, rendering, encoding and writing, in milliseconds.
+	// Decoding shared by outputs of the source is not included, failures of the source have the time until the failure.
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// failedEvent returns event of the error
+func failedEvent(source string, profile string, output string, err error) event {
+	return event{
+		Type:      eventOutput,
+		Source:    source,
+		Profile:   profile,
+		Output:    output,
+		Status:    statusFailed,
+		ErrorCode: errorCode(err),
+		Error:     err.Error(),
+	}
+}
+
+// errorCode returns stable name of the error, so it can be checked without parsing the message
+func errorCode(err error) string {
+	var pathErr *os.PathError
+
+	switch {
+	case errors.Is(err, sharpei.ErrUnsupportedFormat):
+		return "unsupported_format"
+	case errors.Is(err, sharpei.ErrCorruptImage):
+		return "corrupt_image"
+	case errors.Is(err, sharpei.ErrOutOfMemory):
+		return "out_of_memory"
+	case errors.Is(err, sharpei.ErrProfileNotFound):
+		return "profile_not_found"
+	case errors.Is(err, sharpei.ErrBadProfile):
+		return "bad_profile"
+	case errors.Is(err, sharpei.ErrLimitExceeded):
+		return "limit_exceeded"
+	case errors.Is(err, context.Canceled):
+		return "interrupted"
+	case errors.As(err, &pathErr):
+		return "io_error"
+	}
+
+	return "error"
+}
+
+// text returns the event as a line of the text format
+func (e event) text() string {
+	path := e.Output
+	if path == "" {
+		path = e.Source
+	}
+
+	switch e.Status {
+	case statusWritten, statusOK:
+		return fmt.Sprintf("%s: %s", path, col.GreenString("OK"))
+	case statusRemoved:
+		return fmt.Sprintf("%s: %s", path, col.GreenString("removed"))
+	case statusInterrupted:
+		return fmt.Sprintf("%s: %s", path, col.RedString("interrupted"))
+	case statusSkipped:
+		switch e.Reason {
+		case reasonUpToDate:
+			return fmt.Sprintf("%s: %s", path, col.GreenString("up to date, skipping"))
+		case reasonNotAnImage:
+			return fmt.Sprintf("%s: %s", path, col.RedString("not an image, skipping"))
+		}
+
+		return fmt.Sprintf("%s: %s", path, col.RedString("already exists, skipping"))
+	}
+
+	if e.Profile != "" && e.Output == "" {
+		return fmt.Sprintf("%s: error while processing profile %s: %s", path, e.Profile, col.RedString(e.Error))
+	}
+
+	return fmt.Sprintf("%s: %s", path, col.RedString(e.Error))
+}
+
+// reporter prints events in the chosen format and counts them in the summary
+type reporter struct {
+	format string
+	sum    summary
+
+	// Events of the json format, they are printed together when the run is over
+	events []event
+}
+
+func newReporter(format string) (*reporter, error) {
+	switch format {
+	case outputText, outputJSON, outputNDJSON:
+		return &reporter{format: format}, nil
+	}
+
+	return nil, errors.Errorf("unknown output format %s, use text, json or ndjson", format)
+}
+
+func (r *reporter) report(e event) {
+	switch e.Status {
+	case statusWritten:
+		r.sum.written++
+		r.sum.outputBytes += e.Bytes
+	case statusSkipped:
+		// Skipped inputs which are not images are not outputs
+		if e.Output != "" {
+			r.sum.skipped++
+		}
+	case statusFailed:
+		r.sum.failed++
+	case statusInterrupted:
+		r.sum.interrupted++
+	}
+
+	switch r.format {
+	case outputJSON:
+		r.events = append(r.events, e)
+	case outputNDJSON:
+		_ = json.NewEncoder(os.Stdout).Encode(e)
+	default:
+		fmt.Println(e.text())
+	}
+}
+
+// finish prints the summary, text is called to print it in the text format
+func (r *reporter) finish(text func()) {
+	switch r.format {
+	case outputJSON:
+		events := r.events
+		if events == nil {
+			events = []event{}
+		}
+
+		content, _ := json.MarshalIndent(struct {
+			Events  []event      `json:"events"`
+			Summary summaryEvent `json:"summary"`
+		}{
+			Events:  events,
+			Summary: r.sum.event(),
+		}, "", "  ")
+
+		fmt.Println(string(content))
+	case outputNDJSON:
+		_ = json.NewEncoder(os.Stdout).Encode(r.sum.event())
+	default:
+		text()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	col "github.com/fatih/color"
+)
+
+// interruptContext returns context which is cancelled on the first SIGINT or SIGTERM, so no new images
+// are started and images in progress are aborted. On the second signal temporary files are removed
+// and the process exits immediately. Returned function restores default handling of the signals.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	interrupt := make(chan os.Signal, 2)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-interrupt:
+			fmt.Fprintln(messages, col.RedString("Interrupted, stopping, press Ctrl+C again to exit immediately"))
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-interrupt:
+			removeTempFiles()
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(interrupt)
+		close(done)
+		cancel()
+	}
+}
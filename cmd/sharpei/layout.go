@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+// isInside returns true if path is inside of the directory or is the directory itself
+func isInside(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// layoutPath returns path of the output file according to the layout of the output directory,
+// paths resolving outside of the output directory are rejected
+func layoutPath(cfg *sharpei.Config, src *sourceInfo, profileName string, filename string) (string, error) {
+	var dir string
+
+	switch strings.ToLower(cfg.Layout) {
+	case "", "mirror":
+		dir = src.dir()
+	case "flat":
+		dir = "."
+	case "by-profile":
+		dir = profileName
+	case "by-date":
+		dir = filepath.FromSlash(src.date.Format("2006/01/02"))
+	default:
+		return "", errors.Errorf("unsupported layout %s, use mirror, flat, by-profile or by-date", cfg.Layout)
+	}
+
+	output, err := filepath.Abs(cfg.Output)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := filepath.Join(output, dir, filename)
+
+	if !isInside(output, filepath.Dir(outputPath)) {
+		return "", errors.Errorf("output path %s is outside of the output directory %s", outputPath, cfg.Output)
+	}
+
+	// Keep paths relative if the output directory is relative
+	if !filepath.IsAbs(cfg.Output) {
+		if rel, err := filepath.Rel(output, outputPath); err == nil {
+			return filepath.Join(cfg.Output, rel), nil
+		}
+	}
+
+	return outputPath, nil
+}
+
+// resolvePath returns absolute path with symbolic links followed. Missing part of the path can not contain links,
+// so only the nearest existing parent is resolved and the rest is appended to it.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return "", err
+		}
+
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
+
+// checkResolvedPath returns error if the path resolves outside of the output directory after following symbolic links.
+// Path and the output directory do not have to exist yet, so it can be checked before directories are created.
+func checkResolvedPath(output string, path string) error {
+	outputResolved, err := resolvePath(output)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+
+	if !isInside(outputResolved, resolved) {
+		return errors.Errorf("output directory %s resolves outside of the output directory %s", path, output)
+	}
+
+	return nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	col "github.com/fatih/color"
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+// Exit codes of the process
+const (
+	exitOK = 0
+	// Some images or outputs failed
+	exitFailed = 1
+	// Invalid config or arguments
+	exitUsage = 2
+	// Nothing was written, returned only with -strict
+	exitNothingToDo = 3
+	// Run was interrupted by a signal
+	exitInterrupted = 130
+)
+
+// fatal prints the error and exits with the code
+func fatal(code int, v ...interface{}) {
+	log.Print(v...)
+	os.Exit(code)
+}
+
+// inputFile is a file to process and the root directory of the path it was found in
+type inputFile struct {
+	path string
+	root string
+}
+
+func usage() {
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [watch] [OPTIONS] PATH [PATH] ...\n       %s verify [OPTIONS] PATH [PATH] ...\n       %s serve [OPTIONS]\n       %s sign [OPTIONS] URL [URL] ...\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+// inputRoot returns directory relative to which outputs of the initial path are mirrored:
+// working directory for paths inside it, the path itself (or its directory for files) otherwise
+func inputRoot(path string, isDir bool) string {
+	clean := filepath.Clean(path)
+	if !filepath.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "."
+	}
+
+	if isDir {
+		return clean
+	}
+
+	return filepath.Dir(clean)
+}
+
+func getPathsToProcess(initialPaths []string, recursive bool) []inputFile {
+	result := make([]inputFile, 0, 64)
+
+	for _, path := range initialPaths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+
+		root := inputRoot(path, stat.IsDir())
+
+		if stat.IsDir() {
+			if recursive {
+				err := filepath.Walk(path,
+					func(walkPath string, info os.FileInfo, err error) error {
+						if err != nil {
+							return err
+						}
+
+						if info.IsDir() {
+							return nil
+						}
+
+						result = append(result, inputFile{path: walkPath, root: root})
+						return nil
+					})
+
+				if err != nil {
+					fatal(exitUsage, err)
+				}
+			} else {
+				files, err := ioutil.ReadDir(path)
+				if err != nil {
+					fatal(exitUsage, err)
+				}
+
+				for _, file := range files {
+					if file.IsDir() {
+						continue
+					}
+
+					result = append(result, inputFile{path: filepath.Join(path, file.Name()), root: root})
+				}
+			}
+
+			continue
+		}
+
+		result = append(result, inputFile{path: path, root: root})
+	}
+
+	return result
+}
+
+func main() {
+	flag.Usage = usage
+
+	var (
+		config = flag.String("config", "", "path to config")
+
+		output    = flag.String("output", ".", "output directory")
+		format    = flag.String("format", "{name}_{profile}", "format of output filenames")
+		layout    = flag.String("layout", "mirror", "layout of the output directory: mirror, flat, by-profile or by-date")
+		rewrite   = flag.Bool("rewrite", false, "if set, rewrite existing files")
+		recursive = flag.Bool("recursive", false, "if set, process directories recursively")
+
+		incremental = flag.Bool("incremental", false, "if set, process only sources and profiles which changed since the last run")
+		cachePath   = flag.String("cache", "", "path to the cache of incremental mode, default is .sharpei-cache.json in the output directory")
+
+		watch         = flag.Bool("watch", false, "if set, watch paths and process images as they appear or change")
+		deleteOutputs = flag.Bool("delete-outputs", false, "if set, remove outputs of the removed images in watch mode")
+		debounce      = flag.Duration("debounce", 500*time.Millisecond, "time without changes after which the image is processed in watch mode")
+
+		addr      = flag.String("addr", ":8080", "address to listen on in server mode")
+		root      = flag.String("root", ".", "directory with source images in server mode")
+		cacheDir  = flag.String("cache-dir", "", "directory of rendered images cache in server mode, default is sharpei in the user cache directory")
+		cacheSize = flag.Int64("cache-size", 512, "size limit of rendered images cache in server mode, in megabytes, 0 disables cache")
+		maxAge    = flag.Duration("max-age", 24*time.Hour, "max-age of the Cache-Control header in server mode")
+
+		maxPixels     = flag.Int64("max-pixels", 0, "largest number of pixels of the source image, 0 means no limit")
+		maxInputBytes = flag.Int64("max-input-bytes", 0, "largest size of the source file in bytes, 0 means no limit")
+		maxFrames     = flag.Int("max-frames", 0, "largest number of frames or pages of the source image, 0 means no limit")
+		timeout       = flag.Duration("timeout", 0, "longest time of processing of a single image, 0 means no limit")
+		failOn        = flag.String("fail-on", "", "fail decoding on problems of this level or more severe: none, truncated, error or warning")
+
+		expires = flag.Duration("expires", 0, "lifetime of signed URLs, 0 means they never expire")
+		baseURL = flag.String("base-url", "", "prefix of signed URLs, for example https://cdn.example.com")
+
+		width         = flag.Int("width", 0, "width of the output image")
+		height        = flag.Int("height", 0, "height of the output image")
+		inputProfile  = flag.String("input-profile", "", "input icc profile")
+		outputProfile = flag.String("output-profile", "", "output icc profile")
+		rotate        = flag.Float64("rotate", 0, "rotation angle in degrees, clockwise")
+		flip          = flag.Bool("flip", false, "if set, flip image vertically")
+		flop          = flag.Bool("flop", false, "if set, flip image horizontally")
+		crop          = flag.String("crop", "", "crop rectangle before resizing: left,top,width,height in pixels or percents")
+		background    = flag.String("background", "", "background colour for the rotation")
+
+		manifestPath = flag.String("manifest", "", "path to the JSON manifest of generated renditions")
+		htmlPath     = flag.String("html", "", "path to the HTML file with <picture> snippets of generated renditions")
+		htmlSizes    = flag.String("html-sizes", "100vw", "value of the sizes attribute in HTML snippets")
+
+		failFast  = flag.Bool("fail-fast", false, "if set, stop on the first failed image")
+		keepGoing = flag.Bool("keep-going", false, "if set, process all images even if some of them fail, it is the default")
+		strict    = flag.Bool("strict", false, "if set, exit with code 3 when there is nothing to do")
+
+		outputFormat = flag.String("output-format", outputText, "format of the results printed to stdout: text, json or ndjson")
+		noColor      = flag.Bool("no-color", false, "disable colorized output")
+	)
+
+	args := os.Args[1:]
+
+	var command string
+	if len(args) > 0 && (args[0] == "watch" || args[0] == "verify" || args[0] == "serve" || args[0] == "sign") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	// "sharpei watch" is the same as "sharpei -watch"
+	if command == "watch" {
+		*watch = true
+	}
+
+	_ = flag.CommandLine.Parse(args)
+
+	if *noColor {
+		col.NoColor = true
+	}
+
+	if *failFast && *keepGoing {
+		fatal(exitUsage, "either -fail-fast or -keep-going can be set, not both")
+	}
+
+	rep, err := newReporter(*outputFormat)
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+
+	// JSON document is printed only when the run is over, which never happens in the watch mode
+	if *watch && rep.format == outputJSON {
+		fatal(exitUsage, "-output-format json can't be used in the watch mode, use ndjson")
+	}
+
+	// Stdout of machine-readable formats contains only events
+	if rep.format != outputText {
+		messages = os.Stderr
+	}
+
+	var cfg *sharpei.Config
+	// Path of the config file, empty for the cli config
+	var configPath string
+
+	// Geometry flags belong to the cli profile, which needs the size of the output
+	if (*rotate != 0 || *flip || *flop || *crop != "" || *background != "") && *width == 0 && *height == 0 {
+		fatal(exitUsage, "-rotate, -flip, -flop, -crop and -background can be used only with -width or -height")
+	}
+
+	if *width != 0 || *height != 0 || *inputProfile != "" || *outputProfile != "" {
+		cfg = &sharpei.Config{
+			Output:  *output,
+			Format:  *format,
+			Layout:  *layout,
+			Rewrite: *rewrite,
+			Profiles: map[string]sharpei.ProfileConfig{
+				"thumbnail": {
+					Width:         *width,
+					Height:        *height,
+					InputProfile:  *inputProfile,
+					OutputProfile: *outputProfile,
+					Rotate:        *rotate,
+					Flip:          *flip,
+					Flop:          *flop,
+					Crop:          *crop,
+					Background:    *background,
+					Type:          "same",
+				},
+			},
+		}
+	}
+
+	if *config != "" {
+		if cfg != nil {
+			fatal(exitUsage, "either external or cli config should be present, not both")
+		}
+
+		var err error
+		cfg, err = sharpei.LoadConfig(*config)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		configPath = *config
+	}
+
+	if cfg == nil {
+		usr, err := user.Current()
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		defaultPaths := []string{
+			"sharpei.yaml",
+			"sharpei.yml",
+			".sharpei.yaml",
+			".sharpei.yml",
+			filepath.Join(usr.HomeDir, ".sharpei.yaml"),
+			filepath.Join(usr.HomeDir, ".sharpei.yml"),
+		}
+		for _, path := range defaultPaths {
+			if _, err := os.Stat(path); err == nil {
+				cfg, err = sharpei.LoadConfig(path)
+				if err != nil {
+					fatal(exitUsage, errors.Wrap(err, path))
+				}
+				configPath = path
+				break
+			}
+		}
+	}
+
+	// Server and verification can be used without profiles
+	if cfg == nil && (command == "serve" || command == "sign" || command == "verify") {
+		cfg = &sharpei.Config{Profiles: map[string]sharpei.ProfileConfig{}}
+	}
+
+	if cfg == nil {
+		fatal(exitUsage, "no config found, searched at: sharpei.yml, .sharpei.yml, ~/.sharpei.yml")
+	}
+
+	// configure sets default values and applies cli options which can be used with any config
+	configure := func(cfg *sharpei.Config) {
+		if cfg.Output == "" {
+			cfg.Output = "."
+		}
+
+		if cfg.Format == "" {
+			cfg.Format = "{name}_{profile}"
+		}
+
+		if cfg.Layout == "" {
+			cfg.Layout = "mirror"
+		}
+
+		if *incremental {
+			cfg.Incremental = true
+		}
+
+		if *cachePath != "" {
+			cfg.Cache = *cachePath
+		}
+
+		if *maxPixels > 0 {
+			cfg.Limits.MaxPixels = *maxPixels
+		}
+
+		if *maxInputBytes > 0 {
+			cfg.Limits.MaxInputBytes = *maxInputBytes
+		}
+
+		if *maxFrames > 0 {
+			cfg.Limits.MaxFrames = *maxFrames
+		}
+
+		if *timeout > 0 {
+			cfg.Limits.Timeout = *timeout
+		}
+
+		if *failOn != "" {
+			cfg.Limits.FailOn = *failOn
+		}
+	}
+
+	configure(cfg)
+
+	if command == "sign" {
+		keys := signingKeys(cfg)
+		if len(keys) == 0 {
+			fatal(exitUsage, "no signing keys, set server.keys in the config or SHARPEI_KEYS environment variable")
+		}
+
+		var expiresAt time.Time
+		if *expires > 0 {
+			expiresAt = time.Now().Add(*expires)
+		}
+
+		for _, rawURL := range flag.Args() {
+			signed, err := signURL(keys[0], rawURL, expiresAt)
+			if err != nil {
+				fatal(exitUsage, errors.Wrap(err, rawURL))
+			}
+
+			fmt.Println(strings.TrimSuffix(*baseURL, "/") + signed)
+		}
+
+		return
+	}
+
+	if command == "serve" {
+		defer sharpei.Shutdown()
+
+		dir := *cacheDir
+		if dir == "" {
+			userCacheDir, err := os.UserCacheDir()
+			if err != nil {
+				userCacheDir = os.TempDir()
+			}
+
+			dir = filepath.Join(userCacheDir, "sharpei")
+		}
+
+		ctx, stop := interruptContext()
+		defer stop()
+
+		err := runServer(ctx, *addr, cfg, serverOptions{
+			root:       *root,
+			cacheDir:   dir,
+			cacheBytes: *cacheSize * 1024 * 1024,
+			maxAge:     *maxAge,
+		})
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+
+		return
+	}
+
+	var initialPaths []string
+	if flag.NArg() == 0 {
+		initialPaths = []string{"."}
+	} else {
+		initialPaths = flag.Args()
+	}
+
+	// Invalid profiles are errors of the config, not failures of images
+	var proc *sharpei.Processor
+	if command != "verify" {
+		proc, err = sharpei.NewProcessor(cfg)
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+	}
+
+	if command == "verify" {
+		inputs := filterImages(getPathsToProcess(initialPaths, *recursive), rep)
+
+		ctx, stop := interruptContext()
+		failed := runVerify(ctx, cfg, inputs, rep)
+		stop()
+		sharpei.Shutdown()
+
+		rep.finish(func() {
+			switch {
+			case failed > 0:
+				fmt.Printf("%s\n", col.RedString("%d of %d images are corrupt", failed, len(inputs)))
+			case len(inputs) == 0 && *strict:
+				col.Green("No images to verify")
+			}
+		})
+
+		switch {
+		case failed > 0:
+			os.Exit(exitFailed)
+		case len(inputs) == 0 && *strict:
+			os.Exit(exitNothingToDo)
+		}
+
+		return
+	}
+
+	if *watch {
+		defer sharpei.Shutdown()
+
+		ctx, stop := interruptContext()
+		defer stop()
+
+		err := runWatch(ctx, proc, cfg, rep, watchOptions{
+			paths:         initialPaths,
+			recursive:     *recursive,
+			deleteOutputs: *deleteOutputs,
+			debounce:      *debounce,
+			configPath:    configPath,
+			reloadConfig: func() (*sharpei.Config, error) {
+				cfg, err := sharpei.LoadConfig(configPath)
+				if err != nil {
+					return nil, err
+				}
+
+				configure(cfg)
+				return cfg, nil
+			},
+			report: func(sources []manifestSource) {
+				writeReports(*manifestPath, *htmlPath, *htmlSizes, sources)
+			},
+		})
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+
+		return
+	}
+
+	imagesToProcess := filterImages(getPathsToProcess(initialPaths, *recursive), rep)
+
+	os.Exit(runBatch(proc, cfg, imagesToProcess, rep, batchOptions{
+		failFast:     *failFast,
+		strict:       *strict,
+		manifestPath: *manifestPath,
+		htmlPath:     *htmlPath,
+		htmlSizes:    *htmlSizes,
+	}))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rendition describes single output file
+type rendition struct {
+	Path    string `json:"path"`
+	Profile string `json:"profile"`
+	Format  string `json:"format"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Bytes   int64  `json:"bytes"`
+	Hash    string `json:"hash"`
+}
+
+type manifestSource struct {
+	Source  string      `json:"source"`
+	Outputs []rendition `json:"outputs"`
+}
+
+type manifest struct {
+	Sources []manifestSource `json:"sources"`
+}
+
+// fileHash returns hex encoded SHA-256 of the file content
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func sortRenditions(renditions []rendition) {
+	sort.Slice(renditions, func(i, j int) bool {
+		if renditions[i].Profile != renditions[j].Profile {
+			return renditions[i].Profile < renditions[j].Profile
+		}
+
+		return renditions[i].Width < renditions[j].Width
+	})
+}
+
+func writeManifest(path string, sources []manifestSource) error {
+	for _, source := range sources {
+		sortRenditions(source.Outputs)
+	}
+
+	content, err := json.MarshalIndent(manifest{Sources: sources}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(content, '\n'), 0644)
+}
+
+// mimeTypes lists formats supported by browsers in order of preference
+var mimeTypes = []struct {
+	formats  []string
+	mimeType string
+}{
+	{[]string{"avif"}, "image/avif"},
+	{[]string{"webp"}, "image/webp"},
+	{[]string{"jpeg", "jpg", "jpe", "jif", "jfif", "jfi"}, "image/jpeg"},
+	{[]string{"png"}, "image/png"},
+}
+
+// srcset returns value of the srcset attribute, paths are relative to the base directory.
+// Browsers need distinct widths, so only the first rendition of every width is used.
+func srcset(baseDir string, renditions []rendition) string {
+	candidates := make([]string, 0, len(renditions))
+	widths := make(map[int]bool, len(renditions))
+
+	for _, r := range renditions {
+		if widths[r.Width] {
+			continue
+		}
+		widths[r.Width] = true
+
+		path := r.Path
+		if rel, err := filepath.Rel(baseDir, r.Path); err == nil {
+			path = rel
+		}
+
+		candidates = append(candidates, fmt.Sprintf("%s %dw", filepath.ToSlash(path), r.Width))
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// pictureHTML returns <picture> element with a <source> element for every format,
+// the last supported format is used as the <img> fallback
+func pictureHTML(baseDir string, sizes string, source manifestSource) string {
+	byType := make([][]rendition, len(mimeTypes))
+
+	for _, r := range source.Outputs {
+		for i, t := range mimeTypes {
+			for _, format := range t.formats {
+				if strings.ToLower(r.Format) == format {
+					byType[i] = append(byType[i], r)
+				}
+			}
+		}
+	}
+
+	fallback := -1
+	for i := len(mimeTypes) - 1; i >= 0; i-- {
+		if len(byType[i]) > 0 {
+			fallback = i
+			break
+		}
+	}
+
+	if fallback == -1 {
+		return ""
+	}
+
+	var b strings.Builder
+
+	b.WriteString("<picture>\n")
+
+	for i := 0; i < fallback; i++ {
+		if len(byType[i]) == 0 {
+			continue
+		}
+
+		sortRenditions(byType[i])
+
+		_, _ = fmt.Fprintf(
+			&b,
+			"  <source type=\"%s\" srcset=\"%s\" sizes=\"%s\">\n",
+			mimeTypes[i].mimeType,
+			html.EscapeString(srcset(baseDir, byType[i])),
+			html.EscapeString(sizes),
+		)
+	}
+
+	sortRenditions(byType[fallback])
+
+	// Renditions are sorted by profile first, so the widest one can be anywhere
+	largest := byType[fallback][0]
+	for _, r := range byType[fallback][1:] {
+		if r.Width > largest.Width {
+			largest = r
+		}
+	}
+
+	src := largest.Path
+	if rel, err := filepath.Rel(baseDir, largest.Path); err == nil {
+		src = rel
+	}
+
+	_, _ = fmt.Fprintf(
+		&b,
+		"  <img src=\"%s\" srcset=\"%s\" sizes=\"%s\" width=\"%d\" height=\"%d\" alt=\"\">\n",
+		html.EscapeString(filepath.ToSlash(src)),
+		html.EscapeString(srcset(baseDir, byType[fallback])),
+		html.EscapeString(sizes),
+		largest.Width,
+		largest.Height,
+	)
+
+	b.WriteString("</picture>\n")
+
+	return b.String()
+}
+
+// writeHTML writes <picture> snippet for every source, paths are relative to the HTML file
+func writeHTML(path string, sizes string, sources []manifestSource) error {
+	baseDir := filepath.Dir(path)
+
+	var b strings.Builder
+
+	for _, source := range sources {
+		picture := pictureHTML(baseDir, sizes, source)
+		if picture == "" {
+			continue
+		}
+
+		_, _ = fmt.Fprintf(&b, "<!-- %s -->\n%s\n", html.EscapeString(source.Source), picture)
+	}
+
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
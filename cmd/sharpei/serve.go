@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	col "github.com/fatih/color"
+	"github.com/meownoid/sharpei"
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// defaultMaxDimension is the largest width and height which can be requested if the config does not set it
+const defaultMaxDimension = 4096
+
+type serverOptions struct {
+	root string
+
+	// Rendered variants are cached in this directory, cache is disabled if cacheBytes is zero
+	cacheDir   string
+	cacheBytes int64
+
+	// Value of max-age in the Cache-Control header
+	maxAge time.Duration
+}
+
+// server renders images from the root directory on request. URL is either /{profile}/{path}
+// or /{path} with parameters w, h, q and fmt, which also override parameters of the profile.
+type server struct {
+	cfg    *sharpei.Config
+	root   string
+	maxAge time.Duration
+	cache  *diskCache
+
+	keys        []string
+	presetsOnly bool
+
+	maxDimension int
+	// Semaphore of renders in progress
+	renders chan struct{}
+}
+
+func newServer(cfg *sharpei.Config, opts serverOptions) (*server, error) {
+	s := &server{
+		cfg:    cfg,
+		root:   filepath.Clean(opts.root),
+		maxAge: opts.maxAge,
+
+		keys:        signingKeys(cfg),
+		presetsOnly: cfg.Server.PresetsOnly,
+
+		maxDimension: cfg.Server.MaxDimension,
+	}
+
+	if s.maxDimension <= 0 {
+		s.maxDimension = defaultMaxDimension
+	}
+
+	concurrency := cfg.Server.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	s.renders = make(chan struct{}, concurrency)
+
+	if opts.cacheBytes > 0 {
+		cache, err := newDiskCache(opts.cacheDir, opts.cacheBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, opts.cacheDir)
+		}
+
+		s.cache = cache
+	}
+
+	return s, nil
+}
+
+// variant is the requested rendition of the source image
+type variant struct {
+	source      string
+	stat        os.FileInfo
+	profileName string
+	profile     sharpei.ProfileConfig
+
+	// Format was chosen by the Accept header
+	negotiated bool
+
+	// Expiration time of the signed URL, zero if there is none
+	expires time.Time
+}
+
+// key returns hash identifying the rendered variant, it changes when the source is modified
+func (v *variant) key() string {
+	content, _ := json.Marshal(struct {
+		Source  string
+		Size    int64
+		ModTime int64
+		Profile sharpei.ProfileConfig
+	}{
+		Source:  v.source,
+		Size:    v.stat.Size(),
+		ModTime: v.stat.ModTime().UnixNano(),
+		Profile: v.profile,
+	})
+
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// acceptsType returns true if the Accept header explicitly lists the MIME type with non-zero quality
+func acceptsType(accept string, mimeType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != mimeType {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// negotiateFormat returns WebP for clients which accept it, PNG for PNG sources and JPEG otherwise
+func negotiateFormat(accept string, sourcePath string) string {
+	if acceptsType(accept, "image/webp") {
+		return "webp"
+	}
+
+	if strings.ToLower(filepath.Ext(sourcePath)) == ".png" {
+		return "png"
+	}
+
+	return "jpeg"
+}
+
+func formatMimeType(format string) string {
+	for _, t := range mimeTypes {
+		for _, f := range t.formats {
+			if f == format {
+				return t.mimeType
+			}
+		}
+	}
+
+	if format == "tiff" || format == "tif" {
+		return "image/tiff"
+	}
+
+	return "application/octet-stream"
+}
+
+// parseRequest returns the requested variant, HTTP status is returned with the error
+func (s *server) parseRequest(r *http.Request) (*variant, int, error) {
+	v := &variant{}
+
+	if len(s.keys) > 0 {
+		expires, err := verifyURL(s.keys, r.URL, time.Now())
+		if err != nil {
+			return nil, http.StatusForbidden, err
+		}
+
+		v.expires = expires
+	}
+
+	urlPath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+	if i := strings.IndexByte(urlPath, '/'); i > 0 {
+		if profile, ok := s.cfg.Profiles[urlPath[:i]]; ok {
+			v.profileName = urlPath[:i]
+			v.profile = profile
+			urlPath = urlPath[i+1:]
+		}
+	}
+
+	query := r.URL.Query()
+
+	if s.presetsOnly {
+		if v.profileName == "" {
+			return nil, http.StatusForbidden, errors.New("only profiles can be requested")
+		}
+
+		for _, name := range []string{"w", "h", "q", "fmt"} {
+			if query.Get(name) != "" {
+				return nil, http.StatusForbidden, errors.Errorf("parameter %s is not allowed", name)
+			}
+		}
+	}
+
+	// Dimensions given in the query replace both dimensions of the profile
+	if query.Get("w") != "" || query.Get("h") != "" {
+		v.profile.Width = 0
+		v.profile.Height = 0
+	}
+
+	// Huge upscaling is expensive, so dimensions of the request are limited
+	params := []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"w", &v.profile.Width, s.maxDimension},
+		{"h", &v.profile.Height, s.maxDimension},
+		{"q", &v.profile.Quality, 0},
+	}
+
+	for _, param := range params {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, http.StatusBadRequest, errors.Errorf("invalid value of %s: %s", param.name, value)
+		}
+
+		if param.max > 0 && n > param.max {
+			return nil, http.StatusBadRequest, errors.Errorf("%s is larger than %d", param.name, param.max)
+		}
+
+		*param.value = n
+	}
+
+	maxPixels := s.cfg.Limits.MaxPixels
+	if maxPixels > 0 && int64(v.profile.Width)*int64(v.profile.Height) > maxPixels {
+		return nil, http.StatusBadRequest, errors.Errorf("image of %dx%d is larger than max_pixels %d", v.profile.Width, v.profile.Height, maxPixels)
+	}
+
+	// Single image is rendered for the ladder, the largest width is used if there are no explicit dimensions
+	if v.profile.Width == 0 && v.profile.Height == 0 {
+		widths, err := sharpei.LadderWidths(v.profile.Widths, v.profile.Ladder)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		if len(widths) > 0 {
+			v.profile.Width = widths[0]
+		}
+	}
+
+	v.profile.Widths = nil
+	v.profile.Ladder = nil
+
+	if v.profile.Width == 0 && v.profile.Height == 0 {
+		return nil, http.StatusBadRequest, errors.New("either w or h should be set")
+	}
+
+	v.source = filepath.Join(s.root, filepath.FromSlash(urlPath))
+
+	if !isInside(s.root, v.source) || !sharpei.IsImage(v.source) {
+		return nil, http.StatusNotFound, errors.New("not found")
+	}
+
+	stat, err := os.Stat(v.source)
+	if err != nil || stat.IsDir() {
+		return nil, http.StatusNotFound, errors.New("not found")
+	}
+
+	// Symbolic links can lead outside of the root directory
+	if err := checkResolvedPath(s.root, v.source); err != nil {
+		return nil, http.StatusNotFound, errors.New("not found")
+	}
+
+	v.stat = stat
+
+	switch format := strings.ToLower(query.Get("fmt")); format {
+	case "jpeg", "jpg", "png", "webp", "tiff", "tif":
+		v.profile.Type = format
+	case "":
+		if v.profile.Type == "" || v.profile.Type == "same" {
+			v.profile.Type = negotiateFormat(r.Header.Get("Accept"), v.source)
+			v.negotiated = true
+		}
+	default:
+		return nil, http.StatusBadRequest, errors.Errorf("unsupported format %s, use jpeg, png, webp or tiff", format)
+	}
+
+	v.profile.Type = strings.ToLower(v.profile.Type)
+
+	return v, http.StatusOK, nil
+}
+
+func (s *server) render(ctx context.Context, v *variant) (*sharpei.Rendition, error) {
+	// Requests over the limit wait, so a burst of requests can not exhaust memory and CPU
+	select {
+	case s.renders <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.renders }()
+
+	img, err := sharpei.OpenForProfiles(v.source, s.cfg.Limits, v.profile)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	ctx, cancel := s.cfg.Limits.WithTimeout(ctx)
+	defer cancel()
+
+	out, err := sharpei.ProcessProfile(ctx, img, v.profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &out.Renditions[0], nil
+}
+
+// renderStatus returns HTTP status of the render error, broken sources are not server errors
+func renderStatus(err error) int {
+	switch {
+	case errors.Is(err, sharpei.ErrUnsupportedFormat), errors.Is(err, sharpei.ErrCorruptImage),
+		errors.Is(err, sharpei.ErrLimitExceeded):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, sharpei.ErrOutOfMemory), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	v, status, err := s.parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	key := v.key()
+	name := key + "." + v.profile.Type
+	etag := `"` + key[:32] + `"`
+
+	// Signed URL should not be cached after it expires
+	maxAge := s.maxAge
+	if !v.expires.IsZero() {
+		if untilExpires := time.Until(v.expires); untilExpires < maxAge {
+			maxAge = untilExpires
+		}
+	}
+
+	setHeaders := func() {
+		h := w.Header()
+		h.Set("Content-Type", formatMimeType(v.profile.Type))
+		h.Set("ETag", etag)
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		if v.negotiated {
+			h.Set("Vary", "Accept")
+		}
+	}
+
+	if s.cache != nil {
+		if f := s.cache.open(name); f != nil {
+			defer func() { _ = f.Close() }()
+
+			setHeaders()
+			http.ServeContent(w, r, name, v.stat.ModTime(), f)
+			return
+		}
+	}
+
+	// Variant is not rendered again if the client already has it
+	if match := r.Header.Get("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		setHeaders()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	out, err := s.render(r.Context(), v)
+	if err != nil {
+		fmt.Printf("%s: %s\n", r.URL.String(), col.RedString(err.Error()))
+		http.Error(w, "failed to render image", renderStatus(err))
+		return
+	}
+
+	if s.cache != nil {
+		if err := s.cache.put(name, out.Data); err != nil {
+			fmt.Printf("%s: %s\n", s.cache.dir, col.RedString(err.Error()))
+		}
+	}
+
+	fmt.Printf("%s: %s\n", r.URL.String(), col.GreenString("OK"))
+
+	setHeaders()
+	http.ServeContent(w, r, name, v.stat.ModTime(), bytes.NewReader(out.Data))
+}
+
+// runServer serves images until ctx is cancelled, requests in progress are finished before it returns
+func runServer(ctx context.Context, addr string, cfg *sharpei.Config, opts serverOptions) error {
+	s, err := newServer(cfg, opts)
+	if err != nil {
+		return err
+	}
+
+	// Server runs for a long time, images leaked by a bug should not exhaust memory
+	vips.SetFinalizers(true)
+
+	srv := &http.Server{Addr: addr, Handler: s}
+
+	stopped := make(chan error, 1)
+
+	go func() {
+		<-ctx.Done()
+		stopped <- srv.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("Serving %s on %s\n", s.root, addr)
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return <-stopped
+}
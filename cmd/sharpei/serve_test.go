@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meownoid/sharpei"
+)
+
+// writePNG writes a small gradient image to the path
+func writePNG(t *testing.T, path string) {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: 128, A: 255})
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sharpei")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return dir
+}
+
+// newTestServer returns server of the root directory with photo.png and sub/photo.png and a thumb profile
+func newTestServer(t *testing.T, cacheBytes int64) *server {
+	t.Helper()
+
+	dir := tempDir(t)
+	root := filepath.Join(dir, "root")
+
+	writePNG(t, filepath.Join(root, "photo.png"))
+	writePNG(t, filepath.Join(root, "sub", "photo.png"))
+
+	cfg := &sharpei.Config{
+		Profiles: map[string]sharpei.ProfileConfig{
+			"thumb": {Width: 32, Type: "png"},
+		},
+	}
+
+	s, err := newServer(cfg, serverOptions{
+		root:       root,
+		cacheDir:   filepath.Join(dir, "cache"),
+		cacheBytes: cacheBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func get(s *server, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	return w
+}
+
+func TestParseRequest(t *testing.T) {
+	s := newTestServer(t, 0)
+
+	tests := []struct {
+		target  string
+		profile string
+		source  string
+		width   int
+		height  int
+		format  string
+	}{
+		{"/thumb/photo.png", "thumb", "photo.png", 32, 0, "png"},
+		{"/thumb/sub/photo.png?w=16", "thumb", "sub/photo.png", 16, 0, "png"},
+		{"/photo.png?w=20&h=10&fmt=webp", "", "photo.png", 20, 10, "webp"},
+		{"/sub/photo.png?h=12", "", "sub/photo.png", 0, 12, "png"},
+	}
+
+	for _, test := range tests {
+		v, status, err := s.parseRequest(httptest.NewRequest(http.MethodGet, test.target, nil))
+		if err != nil {
+			t.Errorf("%s: status %d: %s", test.target, status, err)
+			continue
+		}
+
+		if v.profileName != test.profile {
+			t.Errorf("%s: profile: got %q, want %q", test.target, v.profileName, test.profile)
+		}
+
+		if want := filepath.Join(s.root, filepath.FromSlash(test.source)); v.source != want {
+			t.Errorf("%s: source: got %s, want %s", test.target, v.source, want)
+		}
+
+		if v.profile.Width != test.width || v.profile.Height != test.height {
+			t.Errorf("%s: size: got %dx%d, want %dx%d", test.target, v.profile.Width, v.profile.Height, test.width, test.height)
+		}
+
+		if v.profile.Type != test.format {
+			t.Errorf("%s: format: got %s, want %s", test.target, v.profile.Type, test.format)
+		}
+	}
+}
+
+func TestServeBadParameters(t *testing.T) {
+	s := newTestServer(t, 0)
+	s.cfg.Limits.MaxPixels = 1000
+
+	targets := []string{
+		"/photo.png",
+		"/photo.png?w=abc",
+		"/photo.png?w=0",
+		"/photo.png?h=-10",
+		"/photo.png?w=100000",
+		"/photo.png?w=100000&h=100000",
+		"/photo.png?w=100&h=100",
+		"/photo.png?w=10&fmt=gif",
+	}
+
+	for _, target := range targets {
+		if w := get(s, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServeNotFound(t *testing.T) {
+	s := newTestServer(t, 0)
+
+	// Image outside of the root, reachable only by traversal or a symbolic link
+	outside := filepath.Join(filepath.Dir(s.root), "secret.png")
+	writePNG(t, outside)
+
+	if err := os.Symlink(outside, filepath.Join(s.root, "link.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{
+		"/../secret.png?w=10",
+		"/sub/../../secret.png?w=10",
+		"/%2e%2e/secret.png?w=10",
+		"/link.png?w=10",
+		"/missing.png?w=10",
+		"/sub?w=10",
+	}
+
+	for _, target := range targets {
+		if w := get(s, target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestServeMethodNotAllowed(t *testing.T) {
+	s := newTestServer(t, 0)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/thumb/photo.png", nil))
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServeCache(t *testing.T) {
+	s := newTestServer(t, 1024*1024)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	fetch := func() (*http.Response, []byte) {
+		t.Helper()
+
+		resp, err := http.Get(srv.URL + "/thumb/photo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, body
+	}
+
+	// Miss renders the image and stores it in the cache
+	resp, body := fetch()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("miss: got status %d: %s", resp.StatusCode, body)
+	}
+
+	if got := resp.Header.Get("Content-Type"); got != "image/png" {
+		t.Fatalf("miss: got Content-Type %s, want image/png", got)
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size := decoded.Bounds().Size(); size.X != 32 || size.Y != 24 {
+		t.Fatalf("miss: got %dx%d, want 32x24", size.X, size.Y)
+	}
+
+	files, err := ioutil.ReadDir(s.cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || !isCacheName(files[0].Name()) {
+		t.Fatalf("cache has %d files after the miss, want 1", len(files))
+	}
+
+	// Hit is served from the cache without rendering, so the changed cached file is returned as is
+	cached := []byte("cached")
+	if err := ioutil.WriteFile(filepath.Join(s.cache.dir, files[0].Name()), cached, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body = fetch()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("hit: got status %d", resp.StatusCode)
+	}
+
+	if string(body) != string(cached) {
+		t.Fatalf("hit: got %d bytes, want the cached file", len(body))
+	}
+}
+
+func TestDiskCacheKeepsForeignFiles(t *testing.T) {
+	dir := tempDir(t)
+
+	foreign := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(foreign, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newDiskCache(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.put(fmt.Sprintf("%064x.png", 1), []byte("rendered")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(foreign); err != nil {
+		t.Fatalf("foreign file was removed: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+const (
+	signatureParam = "s"
+	expiresParam   = "expires"
+)
+
+// signingKeys returns keys from the config and SHARPEI_KEYS environment variable (comma separated).
+// The first key is used for signing, all of them are accepted, so keys can be rotated.
+func signingKeys(cfg *sharpei.Config) []string {
+	keys := make([]string, 0, len(cfg.Server.Keys))
+
+	for _, key := range cfg.Server.Keys {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range strings.Split(os.Getenv("SHARPEI_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// signature returns HMAC-SHA256 of the path and sorted query parameters except the signature itself
+func signature(key string, urlPath string, query url.Values) []byte {
+	params := url.Values{}
+	for name, values := range query {
+		if name != signatureParam {
+			params[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(urlPath))
+	_, _ = mac.Write([]byte{'?'})
+	_, _ = mac.Write([]byte(params.Encode()))
+
+	return mac.Sum(nil)
+}
+
+// signURL adds signature and, if expires is not zero, expiration time to the URL
+func signURL(key string, rawURL string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del(signatureParam)
+
+	if !expires.IsZero() {
+		query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+
+	query.Set(signatureParam, base64.RawURLEncoding.EncodeToString(signature(key, u.Path, query)))
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// verifyURL checks that the URL is signed with one of the keys and has not expired,
+// expiration time is returned if it is set
+func verifyURL(keys []string, u *url.URL, now time.Time) (time.Time, error) {
+	query := u.Query()
+
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(signatureParam))
+	if err != nil || len(sig) == 0 {
+		return time.Time{}, errors.New("missing or malformed signature")
+	}
+
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(sig, signature(key, u.Path, query)) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return time.Time{}, errors.New("invalid signature")
+	}
+
+	var expires time.Time
+
+	if value := query.Get(expiresParam); value != "" {
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid value of %s: %s", expiresParam, value)
+		}
+
+		expires = time.Unix(timestamp, 0)
+
+		if now.After(expires) {
+			return time.Time{}, errors.New("URL has expired")
+		}
+	}
+
+	return expires, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meownoid/sharpei"
+)
+
+// setEnv sets the environment variable until the end of the test
+func setEnv(t *testing.T, name string, value string) {
+	t.Helper()
+
+	prev, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(name, prev)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	})
+}
+
+func mustSign(t *testing.T, key string, rawURL string, expires time.Time) string {
+	t.Helper()
+
+	signed, err := signURL(key, rawURL, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestSignURL(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	expires := now.Add(time.Hour)
+
+	signed := mustSign(t, "secret", "/thumb/photo.png?w=16&fmt=webp", expires)
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+
+	// reordered returns the query with parameters in the reversed order
+	reordered := func() string {
+		params := strings.Split(u.RawQuery, "&")
+		for i, j := 0, len(params)-1; i < j; i, j = i+1, j-1 {
+			params[i], params[j] = params[j], params[i]
+		}
+
+		return strings.Join(params, "&")
+	}
+
+	// with returns the query with the parameter replaced, empty value removes it
+	with := func(name string, value string) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+
+		if value == "" {
+			q.Del(name)
+		} else {
+			q.Set(name, value)
+		}
+
+		return q.Encode()
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		query string
+		keys  []string
+		now   time.Time
+		valid bool
+	}{
+		{"valid", u.Path, u.RawQuery, []string{"secret"}, now, true},
+		{"reordered params", u.Path, reordered(), []string{"secret"}, now, true},
+		{"rotated key", u.Path, u.RawQuery, []string{"new", "secret"}, now, true},
+		{"tampered path", "/thumb/other.png", u.RawQuery, []string{"secret"}, now, false},
+		{"tampered param", u.Path, with("w", "17"), []string{"secret"}, now, false},
+		{"added param", u.Path, u.RawQuery + "&h=10", []string{"secret"}, now, false},
+		{"removed param", u.Path, with("fmt", ""), []string{"secret"}, now, false},
+		{"tampered expiration", u.Path, with(expiresParam, "1700000000"), []string{"secret"}, now, false},
+		{"missing signature", u.Path, with(signatureParam, ""), []string{"secret"}, now, false},
+		{"malformed signature", u.Path, with(signatureParam, "!!!"), []string{"secret"}, now, false},
+		{"wrong key", u.Path, u.RawQuery, []string{"other"}, now, false},
+		{"no keys", u.Path, u.RawQuery, nil, now, false},
+		{"expired", u.Path, u.RawQuery, []string{"secret"}, expires.Add(time.Second), false},
+	}
+
+	for _, test := range tests {
+		target := &url.URL{Path: test.path, RawQuery: test.query}
+
+		got, err := verifyURL(test.keys, target, test.now)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%s: URL is accepted", test.name)
+		}
+
+		if test.valid && !got.Equal(expires) {
+			t.Errorf("%s: expires: got %s, want %s", test.name, got, expires)
+		}
+	}
+}
+
+func TestSignURLWithoutExpiration(t *testing.T) {
+	u, err := url.Parse(mustSign(t, "secret", "/photo.png?w=16&s=stale", time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Query().Get(expiresParam) != "" {
+		t.Fatalf("%s: expiration is set", u)
+	}
+
+	if values := u.Query()[signatureParam]; len(values) != 1 {
+		t.Fatalf("%s: got %d signatures, want 1", u, len(values))
+	}
+
+	expires, err := verifyURL([]string{"secret"}, u, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !expires.IsZero() {
+		t.Fatalf("got expiration %s, want none", expires)
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	setEnv(t, "SHARPEI_KEYS", " old , ,older")
+
+	cfg := &sharpei.Config{Server: sharpei.ServerConfig{Keys: []string{"new", ""}}}
+
+	keys := signingKeys(cfg)
+	if want := []string{"new", "old", "older"}; strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Fatalf("got keys %q, want %q", keys, want)
+	}
+
+	// URLs signed with keys rotated out of the config are accepted while the keys are in the environment
+	for _, key := range []string{"new", "old", "older"} {
+		u, err := url.Parse(mustSign(t, key, "/thumb/photo.png", time.Time{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := verifyURL(keys, u, time.Now()); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+}
+
+func TestSignedServerPresetsOnly(t *testing.T) {
+	s := newTestServer(t, 0)
+	s.keys = []string{"secret"}
+	s.presetsOnly = true
+
+	expires := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{mustSign(t, "secret", "/thumb/photo.png", expires), http.StatusOK},
+		{mustSign(t, "secret", "/thumb/sub/photo.png", time.Time{}), http.StatusOK},
+		{"/thumb/photo.png", http.StatusForbidden},
+		{mustSign(t, "other", "/thumb/photo.png", expires), http.StatusForbidden},
+		{mustSign(t, "secret", "/thumb/photo.png", time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{mustSign(t, "secret", "/photo.png", expires), http.StatusForbidden},
+		{mustSign(t, "secret", "/thumb/photo.png?w=16", expires), http.StatusForbidden},
+		{mustSign(t, "secret", "/thumb/photo.png?h=16", expires), http.StatusForbidden},
+		{mustSign(t, "secret", "/thumb/photo.png?fmt=webp", expires), http.StatusForbidden},
+		{mustSign(t, "secret", "/photo.png?w=16&h=16&fmt=webp", expires), http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		_, status, err := s.parseRequest(httptest.NewRequest(http.MethodGet, test.target, nil))
+
+		if test.status == http.StatusOK && err != nil {
+			t.Errorf("%s: status %d: %s", test.target, status, err)
+			continue
+		}
+
+		if test.status != http.StatusOK && (err == nil || status != test.status) {
+			t.Errorf("%s: got status %d, want %d", test.target, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	col "github.com/fatih/color"
+)
+
+// summary counts results of the run, it is printed when the run is over
+type summary struct {
+	// Sources which were processed, including failed ones
+	images int
+	// Sources which were not processed because the run was interrupted
+	interrupted int
+	// Sources which were not processed because of the failure in the fail-fast mode
+	stoppedOnError int
+
+	written int
+	skipped int
+	// Sources, profiles and outputs which failed
+	failed int
+
+	// Sizes of the sources with written outputs and of the written outputs
+	inputBytes  int64
+	outputBytes int64
+}
+
+// summaryEvent is the summary in machine-readable formats
+type summaryEvent struct {
+	Type           string `json:"type"`
+	Images         int    `json:"images"`
+	Interrupted    int    `json:"interrupted"`
+	StoppedOnError int    `json:"stopped_on_error"`
+	Written        int    `json:"written"`
+	Skipped        int    `json:"skipped"`
+	Failed         int    `json:"failed"`
+	InputBytes     int64  `json:"input_bytes"`
+	OutputBytes    int64  `json:"output_bytes"`
+}
+
+func (s *summary) event() summaryEvent {
+	return summaryEvent{
+		Type:           eventSummary,
+		Images:         s.images,
+		Interrupted:    s.interrupted,
+		StoppedOnError: s.stoppedOnError,
+		Written:        s.written,
+		Skipped:        s.skipped,
+		Failed:         s.failed,
+		InputBytes:     s.inputBytes,
+		OutputBytes:    s.outputBytes,
+	}
+}
+
+func (s *summary) print() {
+	fmt.Printf("Processed %d images: %d outputs written, %d skipped, %d failed\n", s.images, s.written, s.skipped, s.failed)
+
+	// Every source has several outputs, so the totals are not comparable as savings
+	if s.inputBytes > 0 {
+		fmt.Printf("Total size: sources %s, written outputs %s\n", formatBytes(s.inputBytes), formatBytes(s.outputBytes))
+	}
+
+	if s.interrupted > 0 {
+		fmt.Println(col.RedString("Interrupted, %d images were not processed", s.interrupted))
+	}
+
+	if s.stoppedOnError > 0 {
+		fmt.Println(col.RedString("Stopped on the first failure, %d images were not processed", s.stoppedOnError))
+	}
+}
+
+// exitCode returns exit code of the run, with strict run which has written nothing has nothing to do
+func (s *summary) exitCode(strict bool) int {
+	switch {
+	case s.interrupted > 0:
+		return exitInterrupted
+	case s.failed > 0:
+		return exitFailed
+	case strict && s.written == 0:
+		return exitNothingToDo
+	}
+
+	return exitOK
+}
+
+// formatBytes returns size in the largest unit which keeps it at least one
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n) / unit
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f TB", value)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meownoid/sharpei"
+	"github.com/meownoid/stempl"
+	"github.com/pkg/errors"
+)
+
+// sourceInfo holds information about the source image used in filename templates
+type sourceInfo struct {
+	path string
+	root string
+	name string
+	date time.Time
+	hash string
+}
+
+func newSourceInfo(path string, root string, img *sharpei.Image) *sourceInfo {
+	basename := filepath.Base(path)
+
+	return &sourceInfo{
+		path: path,
+		root: root,
+		name: strings.TrimSuffix(basename, filepath.Ext(basename)),
+		date: captureDate(path, img),
+	}
+}
+
+// dir returns directory of the source relative to its input root
+func (s *sourceInfo) dir() string {
+	dir := filepath.Dir(s.path)
+
+	if rel, err := filepath.Rel(s.root, dir); err == nil {
+		return rel
+	}
+
+	return dir
+}
+
+// contentHash returns hex encoded SHA-256 of the source file, it is computed on the first call
+func (s *sourceInfo) contentHash() (string, error) {
+	if s.hash != "" {
+		return s.hash, nil
+	}
+
+	hash, err := fileHash(s.path)
+	if err != nil {
+		return "", err
+	}
+
+	s.hash = hash
+	return hash, nil
+}
+
+// captureDate returns capture date from EXIF metadata, file modification time is used if there is none
+func captureDate(path string, img *sharpei.Image) time.Time {
+	if !img.Date.IsZero() {
+		return img.Date
+	}
+
+	if stat, err := os.Stat(path); err == nil {
+		return stat.ModTime()
+	}
+
+	return time.Now()
+}
+
+// templateKeys returns names of all fields of the format string
+func templateKeys(format string) []string {
+	keys := make([]string, 0, 8)
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '{' {
+			continue
+		}
+
+		// Escaped brace
+		if i+1 < len(format) && format[i+1] == '{' {
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(format[i+1:], '}')
+		if end == -1 {
+			break
+		}
+
+		keys = append(keys, format[i+1:i+1+end])
+		i += end + 1
+	}
+
+	return keys
+}
+
+// truncatedHash returns hash shortened to the length given after colon in the key, like hash:8
+func truncatedHash(key string, hash string) (string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) == 1 {
+		return hash, nil
+	}
+
+	length, err := strconv.Atoi(parts[1])
+	if err != nil || length <= 0 {
+		return "", errors.Errorf("invalid hash length in {%s}", key)
+	}
+
+	if length > len(hash) {
+		length = len(hash)
+	}
+
+	return hash[:length], nil
+}
+
+// formatFilename formats output filename without extension, filename can contain subdirectories
+func formatFilename(format string, profileName string, src *sourceInfo, out *sharpei.Rendition) (string, error) {
+	width := out.Width
+	if out.Rung > 0 {
+		width = out.Rung
+	}
+
+	values := map[string]string{
+		"profile": profileName,
+		"name":    src.name,
+		"width":   strconv.Itoa(width),
+		"height":  strconv.Itoa(out.Height),
+		"ext":     out.Format,
+		"quality": strconv.Itoa(out.Quality),
+		"dir":     filepath.ToSlash(src.dir()),
+	}
+
+	for _, key := range templateKeys(format) {
+		switch {
+		case key == "hash" || strings.HasPrefix(key, "hash:"):
+			value, err := truncatedHash(key, out.Hash)
+			if err != nil {
+				return "", err
+			}
+			values[key] = value
+		case key == "src_hash" || strings.HasPrefix(key, "src_hash:"):
+			hash, err := src.contentHash()
+			if err != nil {
+				return "", err
+			}
+			value, err := truncatedHash(key, hash)
+			if err != nil {
+				return "", err
+			}
+			values[key] = value
+		case key == "date":
+			values[key] = src.date.Format("2006-01-02")
+		case strings.HasPrefix(key, "date:"):
+			values[key] = src.date.Format(strings.TrimPrefix(key, "date:"))
+		}
+	}
+
+	filename, err := stempl.Format(format, values)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.FromSlash(filename), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/meownoid/sharpei"
+)
+
+// runVerify fully decodes every image and reports corrupt ones until ctx is cancelled,
+// number of corrupt images is returned
+func runVerify(ctx context.Context, cfg *sharpei.Config, inputs []inputFile, rep *reporter) int {
+	for i, input := range inputs {
+		if ctx.Err() != nil {
+			rep.sum.interrupted += len(inputs) - i
+			break
+		}
+
+		rep.sum.images++
+		start := time.Now()
+
+		ev := event{Type: eventVerify, Source: input.path, Status: statusOK}
+
+		if err := sharpei.Verify(input.path, cfg.Limits); err != nil {
+			ev = failedEvent(input.path, "", "", err)
+			ev.Type = eventVerify
+		}
+
+		ev.DurationMS = time.Since(start).Milliseconds()
+		rep.report(ev)
+	}
+
+	return rep.sum.failed
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	col "github.com/fatih/color"
+	"github.com/meownoid/sharpei"
+	"github.com/pkg/errors"
+)
+
+type watchOptions struct {
+	paths         []string
+	recursive     bool
+	deleteOutputs bool
+	debounce      time.Duration
+
+	// Config is reloaded when this file changes, empty for the cli config
+	configPath   string
+	reloadConfig func() (*sharpei.Config, error)
+
+	// report is called with all sources after every processed batch of changes
+	report func(sources []manifestSource)
+}
+
+// watchedPath is one of the paths given to the watch mode
+type watchedPath struct {
+	path  string
+	isDir bool
+	root  string
+}
+
+// match returns true if the changed file belongs to the watched path
+func (w watchedPath) match(path string, recursive bool) bool {
+	if !w.isDir {
+		return filepath.Clean(path) == w.path
+	}
+
+	if recursive {
+		return isInside(w.path, path)
+	}
+
+	return filepath.Dir(filepath.Clean(path)) == w.path
+}
+
+// pendingFile is a changed file which is processed when there are no more changes during the debounce interval
+type pendingFile struct {
+	deadline time.Time
+	size     int64
+}
+
+func fileSize(path string) int64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+
+	return stat.Size()
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return path
+}
+
+// runWatch processes all images and then processes images as they appear or change until ctx is cancelled
+func runWatch(ctx context.Context, proc *sharpei.Processor, cfg *sharpei.Config, rep *reporter, opts watchOptions) error {
+	w, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = w.Close() }()
+
+	watched := make([]watchedPath, 0, len(opts.paths))
+
+	for _, path := range opts.paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if stat.IsDir() {
+			err = w.add(path, opts.recursive)
+		} else {
+			err = w.add(filepath.Dir(path), false)
+		}
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+
+		watched = append(watched, watchedPath{
+			path:  filepath.Clean(path),
+			isDir: stat.IsDir(),
+			root:  inputRoot(path, stat.IsDir()),
+		})
+	}
+
+	// Config is watched through its directory, because editors often replace files instead of writing them
+	var configAbs string
+	if opts.configPath != "" {
+		configAbs = absPath(opts.configPath)
+
+		if err := w.add(filepath.Dir(opts.configPath), false); err != nil {
+			return errors.Wrap(err, opts.configPath)
+		}
+	}
+
+	cache := openCache(cfg)
+	defer func() { saveCache(cfg, cache) }()
+
+	sum := &rep.sum
+	defer rep.finish(sum.print)
+
+	sources := map[string]manifestSource{}
+	// Outputs are ignored when they are written into the watched directories
+	outputs := map[string]bool{}
+
+	report := func() {
+		result := make([]manifestSource, 0, len(sources))
+		for _, source := range sources {
+			result = append(result, source)
+		}
+
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Source < result[j].Source
+		})
+
+		opts.report(result)
+	}
+
+	process := func(inputs []inputFile) {
+		for i, input := range inputs {
+			if ctx.Err() != nil {
+				sum.interrupted += len(inputs) - i
+				break
+			}
+
+			source := processImage(ctx, proc, cfg, cache, input, rep)
+
+			for _, r := range source.Outputs {
+				outputs[absPath(r.Path)] = true
+			}
+
+			if len(source.Outputs) > 0 {
+				sources[input.path] = source
+			} else {
+				delete(sources, input.path)
+			}
+		}
+
+		saveCache(cfg, cache)
+		report()
+	}
+
+	processAll := func() {
+		process(filterImages(getPathsToProcess(opts.paths, opts.recursive), rep))
+	}
+
+	// remove drops the removed source from reports, its outputs are removed only with -delete-outputs
+	remove := func(path string) {
+		source, ok := sources[path]
+		if !ok {
+			return
+		}
+
+		if opts.deleteOutputs {
+			for _, r := range source.Outputs {
+				if err := os.Remove(r.Path); err != nil && !os.IsNotExist(err) {
+					rep.report(failedEvent(path, r.Profile, r.Path, err))
+					continue
+				}
+
+				delete(outputs, absPath(r.Path))
+				rep.report(event{Type: eventOutput, Source: path, Profile: r.Profile, Output: r.Path, Status: statusRemoved})
+			}
+
+			// Entries are dropped only with the outputs, kept outputs stay fresh if the same source comes back
+			if cache != nil {
+				for profileName := range cfg.Profiles {
+					delete(cache.Entries, cacheKey(path, profileName))
+				}
+			}
+		}
+
+		delete(sources, path)
+
+		saveCache(cfg, cache)
+		report()
+	}
+
+	reload := func() {
+		newCfg, err := opts.reloadConfig()
+		if err != nil {
+			fmt.Fprintf(messages, "%s: %s\n", opts.configPath, col.RedString(err.Error()+", keeping the previous config"))
+			return
+		}
+
+		newProc, err := sharpei.NewProcessor(newCfg)
+		if err != nil {
+			fmt.Fprintf(messages, "%s: %s\n", opts.configPath, col.RedString(err.Error()+", keeping the previous config"))
+			return
+		}
+
+		fmt.Fprintf(messages, "%s: %s\n", opts.configPath, col.GreenString("reloaded"))
+
+		saveCache(cfg, cache)
+		cfg = newCfg
+		proc = newProc
+		cache = openCache(cfg)
+
+		processAll()
+	}
+
+	processAll()
+
+	tick := opts.debounce / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	pending := map[string]*pendingFile{}
+
+	fmt.Fprintln(messages, col.GreenString("Watching for changes, press Ctrl+C to stop"))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-w.Errors():
+			fmt.Fprintf(messages, "watch: %s\n", col.RedString(err.Error()))
+		case path, ok := <-w.Events():
+			if !ok {
+				return errors.New("watch: watcher has stopped")
+			}
+
+			pending[path] = &pendingFile{
+				deadline: time.Now().Add(opts.debounce),
+				size:     fileSize(path),
+			}
+		case now := <-ticker.C:
+			ready := make([]inputFile, 0, len(pending))
+
+			for path, p := range pending {
+				if now.Before(p.deadline) {
+					continue
+				}
+
+				// File is still being written without events, for example over network
+				if size := fileSize(path); size != p.size {
+					p.size = size
+					p.deadline = now.Add(opts.debounce)
+					continue
+				}
+
+				delete(pending, path)
+
+				if configAbs != "" && absPath(path) == configAbs {
+					if p.size >= 0 {
+						reload()
+					}
+					continue
+				}
+
+				if outputs[absPath(path)] || !sharpei.IsImage(path) {
+					continue
+				}
+
+				for _, wp := range watched {
+					if !wp.match(path, opts.recursive) {
+						continue
+					}
+
+					if p.size < 0 {
+						remove(path)
+					} else {
+						ready = append(ready, inputFile{path: path, root: wp.root})
+					}
+					break
+				}
+			}
+
+			if len(ready) > 0 {
+				sort.Slice(ready, func(i, j int) bool {
+					return ready[i].path < ready[j].path
+				})
+
+				process(ready)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE
+
+type watchedDir struct {
+	path      string
+	recursive bool
+}
+
+// watcher reports paths of files which are created, modified, moved or removed in the watched directories
+type watcher struct {
+	fd   int
+	file *os.File
+
+	mu   sync.Mutex
+	dirs map[int32]watchedDir
+
+	paths chan string
+	errs  chan error
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &watcher{
+		fd: fd,
+		// Non-blocking descriptor is handled by the runtime poller, so Close interrupts Read
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		dirs:  map[int32]watchedDir{},
+		paths: make(chan string, 256),
+		errs:  make(chan error, 16),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// add watches the directory and, if recursive, all of its subdirectories including new ones
+func (w *watcher) add(dir string, recursive bool) error {
+	if !recursive {
+		return w.addDir(dir, false)
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		return w.addDir(path, true)
+	})
+}
+
+func (w *watcher) addDir(dir string, recursive bool) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return errors.Wrap(os.NewSyscallError("inotify_add_watch", err), dir)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Same directory can be added twice, the first path is kept so reported paths are consistent
+	if existing, ok := w.dirs[int32(wd)]; ok {
+		existing.recursive = existing.recursive || recursive
+		w.dirs[int32(wd)] = existing
+		return nil
+	}
+
+	w.dirs[int32(wd)] = watchedDir{path: filepath.Clean(dir), recursive: recursive}
+
+	return nil
+}
+
+func (w *watcher) Events() <-chan string {
+	return w.paths
+}
+
+func (w *watcher) Errors() <-chan error {
+	return w.errs
+}
+
+func (w *watcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *watcher) sendError(err error) {
+	select {
+	case w.errs <- err:
+	default:
+	}
+}
+
+func (w *watcher) run() {
+	defer close(w.paths)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			w.sendError(err)
+			return
+		}
+
+		w.handle(buf[:n])
+	}
+}
+
+func (w *watcher) handle(buf []byte) {
+	offset := 0
+
+	for offset+syscall.SizeofInotifyEvent <= len(buf) {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+
+		nameStart := offset + syscall.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		if nameEnd > len(buf) {
+			return
+		}
+
+		offset = nameEnd
+
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.sendError(errors.New("too many changes at once, some of them were missed"))
+			continue
+		}
+
+		w.mu.Lock()
+		dir, ok := w.dirs[event.Wd]
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, event.Wd)
+		}
+		w.mu.Unlock()
+
+		// Name is padded with zero bytes
+		name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+		if !ok || name == "" {
+			continue
+		}
+
+		path := filepath.Join(dir.path, name)
+
+		if event.Mask&syscall.IN_ISDIR != 0 {
+			if dir.recursive && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addNew(path)
+			}
+			continue
+		}
+
+		w.paths <- path
+	}
+}
+
+// addNew watches the new subdirectory and reports files which were created in it before the watch was added
+func (w *watcher) addNew(dir string) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return w.addDir(path, true)
+		}
+
+		w.paths <- path
+		return nil
+	})
+
+	if err != nil {
+		w.sendError(err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+// watcher is implemented with inotify and is available only on Linux
+type watcher struct{}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("watch mode is supported only on Linux")
+}
+
+func (w *watcher) add(dir string, recursive bool) error {
+	return nil
+}
+
+func (w *watcher) Events() <-chan string {
+	return nil
+}
+
+func (w *watcher) Errors() <-chan error {
+	return nil
+}
+
+func (w *watcher) Close() error {
+	return nil
+}
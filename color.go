@@ -0,0 +1,115 @@
+package sharpei
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+var namedColors = map[string][]float64{
+	"black":       {0, 0, 0, 255},
+	"white":       {255, 255, 255, 255},
+	"gray":        {128, 128, 128, 255},
+	"grey":        {128, 128, 128, 255},
+	"red":         {255, 0, 0, 255},
+	"green":       {0, 128, 0, 255},
+	"blue":        {0, 0, 255, 255},
+	"yellow":      {255, 255, 0, 255},
+	"transparent": {0, 0, 0, 0},
+}
+
+// parseColor parses colour written as #rgb, #rrggbb, #rrggbbaa or a colour name
+// and returns its sRGB components and alpha in 0-255 range
+func parseColor(s string) ([]float64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+
+	if c, ok := namedColors[value]; ok {
+		return append([]float64{}, c...), nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return nil, errors.Errorf("invalid colour %s, use #rrggbb, #rrggbbaa or a colour name", s)
+	}
+
+	result := make([]float64, 4)
+	for i := range result {
+		v, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return nil, errors.Errorf("invalid colour %s, use #rrggbb, #rrggbbaa or a colour name", s)
+		}
+		result[i] = float64(v)
+	}
+
+	return result, nil
+}
+
+// colorForImage converts parsed sRGB colour to the band values of the image
+func colorForImage(color []float64, img *vips.Image) []float64 {
+	// 16 bit images use 0-65535 range
+	scale := 1.0
+	if img.Format() == vips.FORMAT_USHORT {
+		scale = 257
+	}
+
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+
+	result := make([]float64, 0, img.Bands())
+
+	if colorBands == 3 {
+		result = append(result, color[0]*scale, color[1]*scale, color[2]*scale)
+	} else {
+		// Rec. 601 luma is good enough for a background colour
+		luma := (0.299*color[0] + 0.587*color[1] + 0.114*color[2]) * scale
+		for i := 0; i < colorBands; i++ {
+			result = append(result, luma)
+		}
+	}
+
+	if img.HasAlpha() {
+		result = append(result, color[3]*scale)
+	}
+
+	return result
+}
+
+// colorToLab converts parsed sRGB colour to the CIE LAB with D50 white point used by vips,
+// XYZ is adapted from D65 of sRGB with the Bradford transform
+func colorToLab(color []float64) [3]float64 {
+	linear := func(v float64) float64 {
+		v /= 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+
+	r, g, b := linear(color[0]), linear(color[1]), linear(color[2])
+
+	x := (0.4360747*r + 0.3850649*g + 0.1430804*b) / 0.96422
+	y := 0.2225045*r + 0.7168786*g + 0.0606169*b
+	z := (0.0139322*r + 0.0971045*g + 0.7141733*b) / 0.82521
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
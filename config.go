@@ -1,4 +1,4 @@
-package main
+package sharpei
 
 import (
 	"io/ioutil"
@@ -7,6 +7,49 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+type WatermarkConfig struct {
+	Image   string  `yaml:"image"`
+	Text    string  `yaml:"text"`
+	Font    string  `yaml:"font"`
+	Size    int     `yaml:"size"`
+	Color   string  `yaml:"color"`
+	Gravity string  `yaml:"gravity"`
+	Margin  int     `yaml:"margin"`
+	Opacity float64 `yaml:"opacity"`
+	Scale   float64 `yaml:"scale"`
+}
+
+type TrimConfig struct {
+	Threshold  float64 `yaml:"threshold"`
+	Background string  `yaml:"background"`
+}
+
+type AdjustConfig struct {
+	Brightness float64 `yaml:"brightness"`
+	Contrast   float64 `yaml:"contrast"`
+	Saturation float64 `yaml:"saturation"`
+	Gamma      float64 `yaml:"gamma"`
+	Grayscale  bool    `yaml:"grayscale"`
+}
+
+type EffectConfig struct {
+	GaussianBlur float64  `yaml:"gaussian_blur"`
+	Pixelate     int      `yaml:"pixelate"`
+	Duotone      []string `yaml:"duotone"`
+	Tint         string   `yaml:"tint"`
+}
+
+type BorderConfig struct {
+	Width int    `yaml:"width"`
+	Color string `yaml:"color"`
+}
+
+type LadderConfig struct {
+	Min  int `yaml:"min"`
+	Max  int `yaml:"max"`
+	Step int `yaml:"step"`
+}
+
 type ProfileConfig struct {
 	Width         int    `yaml:"width"`
 	Height        int    `yaml:"height"`
@@ -15,16 +58,59 @@ type ProfileConfig struct {
 	Type          string `yaml:"type"`
 	Quality       int    `yaml:"quality"`
 	Compression   int    `yaml:"compression"`
+
+	Widths []int         `yaml:"widths"`
+	Ladder *LadderConfig `yaml:"ladder"`
+
+	Rotate     float64 `yaml:"rotate"`
+	Flip       bool    `yaml:"flip"`
+	Flop       bool    `yaml:"flop"`
+	Crop       string  `yaml:"crop"`
+	Background string  `yaml:"background"`
+
+	Trim        *TrimConfig `yaml:"trim"`
+	TrimPadding int         `yaml:"trim_padding"`
+
+	Adjust  *AdjustConfig  `yaml:"adjust"`
+	Effects []EffectConfig `yaml:"effects"`
+
+	Watermark *WatermarkConfig `yaml:"watermark"`
+
+	Mask    string        `yaml:"mask"`
+	Radius  int           `yaml:"radius"`
+	Border  *BorderConfig `yaml:"border"`
+	Padding int           `yaml:"padding"`
+}
+
+// ServerConfig restricts access to the server mode
+type ServerConfig struct {
+	// Requests should be signed with one of the keys, if there are any
+	Keys []string `yaml:"keys"`
+	// Only profiles can be requested, without parameters
+	PresetsOnly bool `yaml:"presets_only"`
+	// Largest width and height which can be requested with parameters, 0 means 4096
+	MaxDimension int `yaml:"max_dimension"`
+	// Largest number of images rendered at once, 0 means number of CPUs
+	MaxConcurrency int `yaml:"max_concurrency"`
 }
 
 type Config struct {
-	Output   string                   `yaml:"output"`
-	Format   string                   `yaml:"format"`
-	Rewrite  bool                     `yaml:"rewrite"`
+	Output  string `yaml:"output"`
+	Format  string `yaml:"format"`
+	Layout  string `yaml:"layout"`
+	Rewrite bool   `yaml:"rewrite"`
+
+	Incremental bool   `yaml:"incremental"`
+	Cache       string `yaml:"cache"`
+
+	Server ServerConfig `yaml:"server"`
+	Limits LimitsConfig `yaml:"limits"`
+
 	Profiles map[string]ProfileConfig `yaml:"profiles"`
 }
 
-func loadConfig(filename string) (*Config, error) {
+// LoadConfig reads the config from the YAML file
+func LoadConfig(filename string) (*Config, error) {
 	r, err := os.Open(filename)
 	if err != nil {
 		return nil, err
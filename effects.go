@@ -0,0 +1,137 @@
+package sharpei
+
+import (
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// pixelate averages image in square blocks of the given size
+func pixelate(img *vips.Image, blockSize int) (*vips.Image, error) {
+	if blockSize <= 1 {
+		return img.Copy()
+	}
+
+	imgSmall, err := img.Resize(1/float64(blockSize), 1/float64(blockSize))
+	if err != nil {
+		return nil, err
+	}
+	defer imgSmall.Destroy()
+
+	return imgSmall.ResizeKernel(
+		float64(img.Width())/float64(imgSmall.Width()),
+		float64(img.Height())/float64(imgSmall.Height()),
+		vips.KERNEL_NEAREST,
+	)
+}
+
+// mapLightness replaces LAB bands of the image with shadow + L / 100 * (highlight - shadow),
+// extra bands (alpha) are preserved
+func mapLightness(img *vips.Image, shadow [3]float64, highlight [3]float64) (*vips.Image, error) {
+	lightness, err := img.ExtractBand(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer lightness.Destroy()
+
+	a := make([]float64, 3)
+	b := make([]float64, 3)
+	for i := range a {
+		a[i] = (highlight[i] - shadow[i]) / 100
+		b[i] = shadow[i]
+	}
+
+	imgMapped, err := lightness.Linear(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if img.Bands() <= 3 {
+		return imgMapped, nil
+	}
+	defer imgMapped.Destroy()
+
+	extra, err := img.ExtractBand(3, img.Bands()-3)
+	if err != nil {
+		return nil, err
+	}
+	defer extra.Destroy()
+
+	return imgMapped.BandJoin(extra)
+}
+
+// duotone maps shadows of the image to one colour and highlights to another
+func duotone(img *vips.Image, colors []string) (*vips.Image, error) {
+	if len(colors) != 2 {
+		return nil, errors.New("duotone should have exactly two colours: shadow and highlight")
+	}
+
+	shadow, err := parseColor(colors[0])
+	if err != nil {
+		return nil, err
+	}
+
+	highlight, err := parseColor(colors[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return mapLightness(img, colorToLab(shadow), colorToLab(highlight))
+}
+
+// tint keeps lightness of the image and replaces its hue and chroma with the ones of the colour
+func tint(img *vips.Image, colorName string) (*vips.Image, error) {
+	color, err := parseColor(colorName)
+	if err != nil {
+		return nil, err
+	}
+
+	lab := colorToLab(color)
+
+	return mapLightness(img, [3]float64{0, lab[1], lab[2]}, [3]float64{100, lab[1], lab[2]})
+}
+
+// applyEffect applies single effect to the image in the LAB PCS space
+func applyEffect(img *vips.Image, effect EffectConfig) (*vips.Image, error) {
+	set := 0
+	for _, isSet := range []bool{effect.GaussianBlur > 0, effect.Pixelate > 0, len(effect.Duotone) > 0, effect.Tint != ""} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return nil, errors.New("every effect should be a separate entry of the list")
+	}
+
+	switch {
+	case effect.GaussianBlur > 0:
+		return img.GaussBlur(effect.GaussianBlur)
+	case effect.Pixelate > 0:
+		return pixelate(img, effect.Pixelate)
+	case len(effect.Duotone) > 0:
+		return duotone(img, effect.Duotone)
+	case effect.Tint != "":
+		return tint(img, effect.Tint)
+	}
+
+	return nil, errors.New("unknown effect, use gaussian_blur, pixelate, duotone or tint")
+}
+
+// applyEffects applies effects to the image in order
+func applyEffects(img *vips.Image, effects []EffectConfig) (*vips.Image, error) {
+	result, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, effect := range effects {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return applyEffect(img, effect)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "effect")
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,15 @@
+package sharpei
+
+import (
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// Errors of the package can be checked with errors.Is, details are available with errors.As and *vips.Error
+var (
+	ErrUnsupportedFormat = vips.ErrUnsupportedFormat
+	ErrCorruptImage      = vips.ErrCorruptImage
+	ErrOutOfMemory       = vips.ErrOutOfMemory
+	ErrBadProfile        = vips.ErrBadProfile
+	ErrProfileNotFound   = errors.New("ICC profile not found")
+)
@@ -0,0 +1,221 @@
+package sharpei
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// cropValue is a crop coordinate, either in pixels or in percents of the image dimension
+type cropValue struct {
+	value   float64
+	percent bool
+}
+
+// resolve returns value in pixels of the image, pixel values are divided by the shrink-on-load factor
+func (v cropValue) resolve(size int, shrink int) int {
+	if v.percent {
+		return int(math.Round(v.value * float64(size) / 100))
+	}
+
+	return int(math.Round(v.value / float64(shrink)))
+}
+
+// parseCrop parses crop rectangle written as "left,top,width,height",
+// each value is either in pixels (100) or in percents (10%)
+func parseCrop(s string) ([4]cropValue, error) {
+	var result [4]cropValue
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return result, errors.Errorf("invalid crop %s, use left,top,width,height", s)
+	}
+
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+
+		if strings.HasSuffix(part, "%") {
+			result[i].percent = true
+			part = strings.TrimSuffix(part, "%")
+		}
+
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil || value < 0 {
+			return result, errors.Errorf("invalid crop %s, use left,top,width,height", s)
+		}
+
+		result[i].value = value
+	}
+
+	return result, nil
+}
+
+// cropRect returns crop rectangle in pixels of the image, width or height is not positive if it is outside of the image
+func cropRect(rect [4]cropValue, imageWidth int, imageHeight int, shrink int) (int, int, int, int) {
+	left := rect[0].resolve(imageWidth, shrink)
+	top := rect[1].resolve(imageHeight, shrink)
+	width := rect[2].resolve(imageWidth, shrink)
+	height := rect[3].resolve(imageHeight, shrink)
+
+	if left+width > imageWidth {
+		width = imageWidth - left
+	}
+
+	if top+height > imageHeight {
+		height = imageHeight - top
+	}
+
+	return left, top, width, height
+}
+
+// cropImage crops rectangle from the image, rectangle is clipped to the image bounds
+func cropImage(img *vips.Image, crop string, shrink int) (*vips.Image, error) {
+	rect, err := parseCrop(crop)
+	if err != nil {
+		return nil, err
+	}
+
+	left, top, width, height := cropRect(rect, img.Width(), img.Height(), shrink)
+
+	if width <= 0 || height <= 0 {
+		return nil, errors.Errorf("crop %s is outside of the image", crop)
+	}
+
+	return img.ExtractArea(left, top, width, height)
+}
+
+// rotateImage rotates image clockwise, angles which are not multiple of 90 degrees
+// enlarge the image and fill new pixels with background
+func rotateImage(img *vips.Image, angle float64, background string) (*vips.Image, error) {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+
+	switch angle {
+	case 0:
+		return img.Copy()
+	case 90:
+		return img.Rot(vips.ANGLE_D90)
+	case 180:
+		return img.Rot(vips.ANGLE_D180)
+	case 270:
+		return img.Rot(vips.ANGLE_D270)
+	}
+
+	if background == "" {
+		if img.HasAlpha() {
+			background = "transparent"
+		} else {
+			background = "white"
+		}
+	}
+
+	color, err := parseColor(background)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.Similarity(angle, colorForImage(color, img))
+}
+
+// trimImage crops away borders of the background colour and pads the result with the same colour
+func trimImage(img *vips.Image, threshold float64, background string, padding int) (*vips.Image, error) {
+	if threshold <= 0 {
+		threshold = 10
+	}
+
+	if background == "" {
+		background = "white"
+	}
+
+	color, err := parseColor(background)
+	if err != nil {
+		return nil, err
+	}
+
+	imgColor := colorForImage(color, img)
+
+	trimColor := imgColor
+	if img.HasAlpha() {
+		trimColor = imgColor[:len(imgColor)-1]
+	}
+
+	left, top, width, height, err := img.FindTrim(threshold, trimColor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whole image is the background, leave it as is
+	if width <= 0 || height <= 0 {
+		return img.Copy()
+	}
+
+	imgTrimmed, err := img.ExtractArea(left, top, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	if padding <= 0 {
+		return imgTrimmed, nil
+	}
+	defer imgTrimmed.Destroy()
+
+	return imgTrimmed.Embed(padding, padding, width+2*padding, height+2*padding, imgColor)
+}
+
+// chain applies operation to the image and destroys it, result of the operation is returned
+func chain(img *vips.Image, op func(*vips.Image) (*vips.Image, error)) (*vips.Image, error) {
+	defer img.Destroy()
+
+	return op(img)
+}
+
+// applyGeometry rotates, flips, crops and trims image in that order
+func applyGeometry(img *vips.Image, cfg TransformConfig) (*vips.Image, error) {
+	result, err := rotateImage(img, cfg.Rotate, cfg.Background)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Flip {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return img.Flip(vips.DIRECTION_VERTICAL)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Flop {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return img.Flip(vips.DIRECTION_HORIZONTAL)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Crop != "" {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return cropImage(img, cfg.Crop, cfg.shrink())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Trim {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return trimImage(img, cfg.TrimThreshold, cfg.TrimBackground, cfg.TrimPadding)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,39 @@
+package sharpei
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// LadderWidths returns distinct widths of the profile in descending order
+func LadderWidths(widths []int, ladder *LadderConfig) ([]int, error) {
+	seen := map[int]bool{}
+	result := make([]int, 0, len(widths))
+
+	add := func(width int) {
+		if width > 0 && !seen[width] {
+			seen[width] = true
+			result = append(result, width)
+		}
+	}
+
+	for _, width := range widths {
+		add(width)
+	}
+
+	if ladder != nil {
+		if ladder.Min <= 0 || ladder.Max < ladder.Min || ladder.Step <= 0 {
+			return nil, errors.New("ladder should have 0 < min <= max and step > 0")
+		}
+
+		for width := ladder.Min; width < ladder.Max; width += ladder.Step {
+			add(width)
+		}
+		add(ladder.Max)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(result)))
+
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package sharpei
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded is returned for images which exceed one of the limits
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// LimitsConfig protects from decompression bombs, corrupt images and images which take too long to process,
+// zero values mean no limit
+type LimitsConfig struct {
+	// Largest number of pixels, width multiplied by height
+	MaxPixels int64 `yaml:"max_pixels"`
+	// Largest size of the source file or stream, in bytes
+	MaxInputBytes int64 `yaml:"max_input_bytes"`
+	// Largest number of frames or pages of animated and multi-page images
+	MaxFrames int `yaml:"max_frames"`
+	// Longest time all profiles can take on a single image
+	Timeout time.Duration `yaml:"timeout"`
+	// Decoding fails on problems of the source of this level or more severe: none, truncated, error or warning
+	FailOn string `yaml:"fail_on"`
+}
+
+// failOn returns level of FailOn as one of the vips.FAIL_ON_* constants
+func (l LimitsConfig) failOn() (int, error) {
+	switch strings.ToLower(l.FailOn) {
+	case "", "none":
+		return vips.FAIL_ON_NONE, nil
+	case "truncated":
+		return vips.FAIL_ON_TRUNCATED, nil
+	case "error":
+		return vips.FAIL_ON_ERROR, nil
+	case "warning":
+		return vips.FAIL_ON_WARNING, nil
+	}
+
+	return 0, errors.Errorf("invalid fail_on %s, use none, truncated, error or warning", l.FailOn)
+}
+
+// checkInputBytes returns error if the source is larger than the limit
+func (l LimitsConfig) checkInputBytes(size int64) error {
+	if l.MaxInputBytes > 0 && size > l.MaxInputBytes {
+		return errors.Wrapf(ErrLimitExceeded, "source is %d bytes, max_input_bytes is %d", size, l.MaxInputBytes)
+	}
+
+	return nil
+}
+
+// checkHeader returns error if the image exceeds the limits, only the header of the image is read
+func (l LimitsConfig) checkHeader(img *vips.Image) error {
+	if l.MaxPixels > 0 {
+		if pixels := int64(img.Width()) * int64(img.Height()); pixels > l.MaxPixels {
+			return errors.Wrapf(ErrLimitExceeded, "image is %dx%d, max_pixels is %d", img.Width(), img.Height(), l.MaxPixels)
+		}
+	}
+
+	if l.MaxFrames > 0 && img.IsPropertySet("n-pages") {
+		if frames, err := img.PropertyInt("n-pages"); err == nil && frames > l.MaxFrames {
+			return errors.Wrapf(ErrLimitExceeded, "image has %d frames, max_frames is %d", frames, l.MaxFrames)
+		}
+	}
+
+	return nil
+}
+
+// readLimited reads the whole source if it is not larger than the limit
+func (l LimitsConfig) readLimited(r io.Reader) (io.Reader, error) {
+	if l.MaxInputBytes <= 0 {
+		return r, nil
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+
+	n, err := io.Copy(buf, io.LimitReader(r, l.MaxInputBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > l.MaxInputBytes {
+		return nil, errors.Wrapf(ErrLimitExceeded, "source is larger than max_input_bytes %d", l.MaxInputBytes)
+	}
+
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// WithTimeout returns context which is cancelled after the timeout of the limits, if there is one
+func (l LimitsConfig) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, l.Timeout)
+}
+
+// killOnDone stops computation of the image when the context is done,
+// returned function should be called before the image is destroyed
+func killOnDone(ctx context.Context, img *vips.Image) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			img.Kill()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,473 @@
+package sharpei
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// vips can be initialized and shut down only once, initMu guards both
+var (
+	initMu      sync.Mutex
+	initialized bool
+	shutDown    bool
+)
+
+// initVips initializes vips on the first use of the package
+func initVips() {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if !initialized {
+		vips.Init("sharpei")
+		initialized = true
+	}
+}
+
+// Shutdown releases resources of vips, package can not be used after that
+func Shutdown() {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if initialized && !shutDown {
+		vips.Shutdown()
+		shutDown = true
+	}
+}
+
+// IsImage returns true if the file has extension of the supported image format
+func IsImage(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filepath.Base(filename))) {
+	case ".jpeg", ".jpg", ".jpe", ".jif", ".jfif", ".jfi":
+		return true
+	case ".png":
+		return true
+	case ".tiff", ".tif":
+		return true
+	case ".webp":
+		return true
+	}
+
+	return false
+}
+
+// Image is a decoded source image, rotated according to its EXIF orientation and without metadata
+type Image struct {
+	img *vips.Image
+
+	// Format of the source, it is used by profiles with type same
+	Format string
+	// Capture date from EXIF metadata, zero if there is none
+	Date time.Time
+
+	// Factor by which the image was shrunk on load, zero means it was not
+	shrink int
+}
+
+// Open loads the image from the file, format of the source is taken from the extension.
+// Pixels are decoded on demand, large images are decoded to a temporary file instead of memory.
+func Open(path string) (*Image, error) {
+	return openShrink(path, vips.ACCESS_RANDOM, 1, vips.FAIL_ON_NONE)
+}
+
+// OpenLimited loads the image from the file like Open, limits are checked before the image is decoded
+func OpenLimited(path string, limits LimitsConfig) (*Image, error) {
+	return OpenForProfiles(path, limits)
+}
+
+// Decode decodes the image, format of the source is detected by its content.
+// Image is read on demand, so r should stay open until the image is closed.
+func Decode(r io.Reader) (*Image, error) {
+	return DecodeLimited(r, LimitsConfig{})
+}
+
+// DecodeLimited decodes the image like Decode, limits are checked before the image is decoded.
+// With max_input_bytes the source is read to memory first, so its size is known.
+func DecodeLimited(r io.Reader, limits LimitsConfig) (*Image, error) {
+	initVips()
+
+	failOn, err := limits.failOn()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = limits.readLimited(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := vips.DecodeStream(r, failOn)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Destroy()
+
+	if err := limits.checkHeader(img); err != nil {
+		return nil, err
+	}
+
+	return newImage(img, loaderFormat(img))
+}
+
+// loaderFormat returns format of the image by name of its loader, like jpegload_source
+func loaderFormat(img *vips.Image) string {
+	if !img.IsPropertySet("vips-loader") {
+		return ""
+	}
+
+	loader := img.PropertyString("vips-loader")
+
+	for _, format := range []string{"jpeg", "png", "webp", "tiff"} {
+		if strings.HasPrefix(loader, format) {
+			return format
+		}
+	}
+
+	return ""
+}
+
+// newImage rotates the decoded image according to EXIF orientation and removes metadata
+func newImage(img *vips.Image, format string) (*Image, error) {
+	// Autorotate
+	imgRotated, err := img.Autorot()
+	if err != nil {
+		imgRotated = img
+	} else {
+		defer imgRotated.Destroy()
+	}
+
+	imgRotatedCopy, err := imgRotated.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Capture date is read from EXIF, so it should be done before removing metadata
+	date := captureDate(imgRotatedCopy)
+
+	// Remove EXIF metadata
+	for _, p := range imgRotatedCopy.Properties() {
+		if strings.HasPrefix(p, "exif") || strings.HasPrefix(p, "iptc") || strings.HasPrefix(p, "xmp") || p == "orientation" {
+			_ = imgRotatedCopy.RemoveProperty(p)
+		}
+	}
+
+	return &Image{
+		img:    imgRotatedCopy,
+		Format: format,
+		Date:   date,
+	}, nil
+}
+
+// captureDate returns capture date from EXIF metadata, zero time is returned if there is none
+func captureDate(img *vips.Image) time.Time {
+	for _, property := range []string{"exif-ifd2-DateTimeOriginal", "exif-ifd0-DateTime"} {
+		if !img.IsPropertySet(property) {
+			continue
+		}
+
+		// Value looks like "2019:08:15 12:34:56 (2019:08:15 12:34:56, ASCII, 20 components, 20 bytes)"
+		value := img.PropertyString(property)
+		if len(value) < 19 {
+			continue
+		}
+
+		date, err := time.ParseInLocation("2006:01:02 15:04:05", value[:19], time.Local)
+		if err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
+
+// Width returns image width, in pixels
+func (img *Image) Width() int {
+	return img.img.Width()
+}
+
+// Height returns image height, in pixels
+func (img *Image) Height() int {
+	return img.img.Height()
+}
+
+// Close releases the image
+func (img *Image) Close() {
+	img.img.Destroy()
+}
+
+// Rendition is an encoded image produced by a profile
+type Rendition struct {
+	Data []byte
+	// File type, like jpeg or webp
+	Format  string
+	Width   int
+	Height  int
+	Quality int
+	// Hex encoded SHA-256 of the data
+	Hash string
+
+	// Width of the ladder rung, zero if profile has no ladder
+	Rung int
+	// Time spent resizing, rendering and encoding the rendition,
+	// decoding and preparation shared with other renditions are not included
+	Duration time.Duration
+}
+
+// Output is the result of a profile. Profiles with widths or ladder produce
+// one rendition per width in descending order, other profiles produce exactly one.
+type Output struct {
+	Renditions []Rendition
+}
+
+// Processor runs all profiles of the config on images
+type Processor struct {
+	cfg *Config
+}
+
+// NewProcessor returns processor of the config, profiles are validated
+func NewProcessor(cfg *Config) (*Processor, error) {
+	if cfg == nil || len(cfg.Profiles) == 0 {
+		return nil, errors.New("config has no profiles")
+	}
+
+	if _, err := cfg.Limits.failOn(); err != nil {
+		return nil, err
+	}
+
+	for name, profile := range cfg.Profiles {
+		if _, err := LadderWidths(profile.Widths, profile.Ladder); err != nil {
+			return nil, errors.Wrapf(err, "profile %s", name)
+		}
+	}
+
+	return &Processor{cfg: cfg}, nil
+}
+
+// Process decodes the image and runs every profile on it
+func (p *Processor) Process(ctx context.Context, r io.Reader) (map[string]Output, error) {
+	img, err := DecodeLimited(r, p.cfg.Limits)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	return p.ProcessImage(ctx, img)
+}
+
+// ProcessFile loads the image from the file shrinking it on load for the profiles and runs every profile on it
+func (p *Processor) ProcessFile(ctx context.Context, path string) (map[string]Output, error) {
+	result := make(map[string]Output, len(p.cfg.Profiles))
+
+	err := p.ProcessFileFunc(ctx, path, nil, func(_ *Image, name string, out Output, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "profile %s", name)
+		}
+
+		result[name] = out
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// FileProfileFunc receives the opened image and the output of the profile or the error which occurred while running it.
+// Returning an error stops processing of the remaining profiles.
+type FileProfileFunc func(img *Image, name string, out Output, err error) error
+
+// ProcessFileFunc loads the image from the file like ProcessFile and runs the named profiles on it, all of them
+// if names is empty. Outputs are not collected, fn receives every profile as soon as it is done, errors of profiles
+// are passed to fn and do not stop processing. Error is returned if the image can not be opened, fn returns an error,
+// or processing is stopped by the context or the timeout of the limits.
+func (p *Processor) ProcessFileFunc(ctx context.Context, path string, names []string, fn FileProfileFunc) error {
+	profiles := p.cfg.Profiles
+
+	if len(names) > 0 {
+		profiles = make(map[string]ProfileConfig, len(names))
+
+		for _, name := range names {
+			profile, ok := p.cfg.Profiles[name]
+			if !ok {
+				return errors.Errorf("unknown profile %s", name)
+			}
+
+			profiles[name] = profile
+		}
+	}
+
+	profileList := make([]ProfileConfig, 0, len(profiles))
+	for _, profile := range profiles {
+		profileList = append(profileList, profile)
+	}
+
+	// Image is shrunk on load only as much as the processed profiles allow
+	img, err := OpenForProfiles(path, p.cfg.Limits, profileList...)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	return p.run(ctx, img, profiles, func(name string, out Output, err error) error {
+		return fn(img, name, out, err)
+	})
+}
+
+// ProcessImage runs every profile on the image sharing the work between them, processing stops on the first error
+// or when the timeout of the limits expires
+func (p *Processor) ProcessImage(ctx context.Context, img *Image) (map[string]Output, error) {
+	result := make(map[string]Output, len(p.cfg.Profiles))
+
+	err := p.run(ctx, img, p.cfg.Profiles, func(name string, out Output, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "profile %s", name)
+		}
+
+		result[name] = out
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// run runs the profiles on the image with the timeout of the limits, expired timeout is reported as ErrLimitExceeded
+func (p *Processor) run(ctx context.Context, img *Image, profiles map[string]ProfileConfig, fn ProfileFunc) error {
+	imageCtx, cancel := p.cfg.Limits.WithTimeout(ctx)
+	defer cancel()
+
+	err := ProcessProfiles(imageCtx, img, profiles, fn)
+
+	// Deadline of the parent context is not the timeout of the limits
+	if err != nil && ctx.Err() == nil && imageCtx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(ErrLimitExceeded, "processing took longer than timeout %s", p.cfg.Limits.Timeout)
+	}
+
+	return err
+}
+
+// ProcessProfile runs the profile on the image, use ProcessProfiles to run several profiles on the same image
+func ProcessProfile(ctx context.Context, img *Image, profile ProfileConfig) (Output, error) {
+	var result Output
+
+	err := ProcessProfiles(ctx, img, map[string]ProfileConfig{"": profile}, func(_ string, out Output, err error) error {
+		result = out
+		return err
+	})
+
+	return result, err
+}
+
+func transformConfig(profile ProfileConfig) TransformConfig {
+	var trim TrimConfig
+	if profile.Trim != nil {
+		trim = *profile.Trim
+	}
+
+	return TransformConfig{
+		Width:         profile.Width,
+		Height:        profile.Height,
+		InputProfile:  profile.InputProfile,
+		OutputProfile: profile.OutputProfile,
+		Rotate:        profile.Rotate,
+		Flip:          profile.Flip,
+		Flop:          profile.Flop,
+		Crop:          profile.Crop,
+		Background:    profile.Background,
+
+		Trim:           profile.Trim != nil,
+		TrimThreshold:  trim.Threshold,
+		TrimBackground: trim.Background,
+		TrimPadding:    profile.TrimPadding,
+
+		Adjust:  profile.Adjust,
+		Effects: profile.Effects,
+	}
+}
+
+// encodeImage applies watermark, mask and border to the transformed image and encodes it
+func encodeImage(profile ProfileConfig, transformedImg *vips.Image) (*Rendition, error) {
+	if profile.Watermark != nil {
+		watermarkedImg, err := ApplyWatermark(transformedImg, *profile.Watermark)
+		if err != nil {
+			return nil, err
+		}
+		defer watermarkedImg.Destroy()
+
+		transformedImg = watermarkedImg
+	}
+
+	fileType := strings.ToLower(profile.Type)
+
+	shapedImg, err := applyShape(transformedImg, profile, formatHasAlpha(fileType))
+	if err != nil {
+		return nil, err
+	}
+	defer shapedImg.Destroy()
+
+	transformedImg = shapedImg
+
+	quality := profile.Quality
+	if quality == 0 {
+		quality = 95
+	}
+	if quality < 1 {
+		quality = 1
+	}
+	if quality > 100 {
+		quality = 100
+	}
+
+	compression := profile.Compression
+	if compression == 0 {
+		compression = 7
+	}
+	if compression < 1 {
+		compression = 1
+	}
+	if compression > 9 {
+		compression = 9
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+
+	switch fileType {
+	case "jpeg", "jpg", "jpe", "jif", "jfif", "jfi":
+		err = transformedImg.EncodeJPEG(buf, quality)
+	case "png":
+		err = transformedImg.EncodePNG(buf, compression)
+	case "tiff", "tif":
+		err = transformedImg.EncodeTIFF(buf)
+	case "webp":
+		err = transformedImg.EncodeWEBP(buf, quality, false)
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedFormat, "file type %s, use jpg, png, webp or tiff", fileType)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "encode %s", fileType)
+	}
+
+	return &Rendition{
+		Data:    buf.Bytes(),
+		Format:  fileType,
+		Hash:    fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())),
+		Width:   transformedImg.Width(),
+		Height:  transformedImg.Height(),
+		Quality: quality,
+	}, nil
+}
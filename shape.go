@@ -0,0 +1,282 @@
+package sharpei
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// formatHasAlpha returns true if files of that type can store alpha channel
+func formatHasAlpha(fileType string) bool {
+	switch fileType {
+	case "png", "tiff", "tif", "webp":
+		return true
+	}
+
+	return false
+}
+
+// outputColor converts sRGB colour to the ICC profile of the image,
+// returned values include alpha if the image has alpha channel
+func outputColor(color []float64, img *vips.Image) ([]float64, error) {
+	black, err := vips.Black(1, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer black.Destroy()
+
+	pixel, err := black.Linear([]float64{1, 1, 1}, color[:3])
+	if err != nil {
+		return nil, err
+	}
+	defer pixel.Destroy()
+
+	pixelCast, err := pixel.Cast(vips.FORMAT_UCHAR)
+	if err != nil {
+		return nil, err
+	}
+	defer pixelCast.Destroy()
+
+	pixelRGB, err := pixelCast.CopyWithInterpretation(vips.INTERPRETATION_sRGB)
+	if err != nil {
+		return nil, err
+	}
+	defer pixelRGB.Destroy()
+
+	pixelMatched, err := matchProfile(pixelRGB, img, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer pixelMatched.Destroy()
+
+	result, err := pixelMatched.Getpoint(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+
+	// Output profile has different number of bands than the image, fall back to the plain conversion
+	if len(result) != colorBands {
+		return colorForImage(color, img), nil
+	}
+
+	if img.HasAlpha() {
+		result = append(result, color[3])
+	}
+
+	return result, nil
+}
+
+// shapeSVG returns SVG document of the given size with the shape of the mask,
+// inset moves the shape away from the edges, attributes are added to the shape element
+func shapeSVG(mask string, radius int, width int, height int, inset float64, attributes string) (string, error) {
+	var shape string
+
+	switch strings.ToLower(mask) {
+	case "circle":
+		r := math.Min(float64(width), float64(height))/2 - inset
+		shape = fmt.Sprintf(
+			`<circle cx="%g" cy="%g" r="%g" %s/>`,
+			float64(width)/2, float64(height)/2, r, attributes,
+		)
+	case "rounded", "":
+		rx := 0.0
+		if mask != "" {
+			rx = math.Max(float64(radius)-inset, 0)
+		}
+		shape = fmt.Sprintf(
+			`<rect x="%g" y="%g" width="%g" height="%g" rx="%g" ry="%g" %s/>`,
+			inset, inset, float64(width)-2*inset, float64(height)-2*inset, rx, rx, attributes,
+		)
+	default:
+		return "", errors.Errorf("unsupported mask %s, use circle or rounded", mask)
+	}
+
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">%s</svg>`,
+		width, height, shape,
+	), nil
+}
+
+// maskImage makes pixels outside of the mask transparent, circle mask crops image to a centered square first
+func maskImage(img *vips.Image, mask string, radius int) (*vips.Image, error) {
+	imgSquare := img
+	if strings.ToLower(mask) == "circle" && img.Width() != img.Height() {
+		size := img.Width()
+		if img.Height() < size {
+			size = img.Height()
+		}
+
+		var err error
+		imgSquare, err = img.ExtractArea((img.Width()-size)/2, (img.Height()-size)/2, size, size)
+		if err != nil {
+			return nil, err
+		}
+		defer imgSquare.Destroy()
+	}
+
+	svg, err := shapeSVG(mask, radius, imgSquare.Width(), imgSquare.Height(), 0, `fill="#fff"`)
+	if err != nil {
+		return nil, err
+	}
+
+	maskImg, err := vips.SvgLoad([]byte(svg))
+	if err != nil {
+		return nil, err
+	}
+	defer maskImg.Destroy()
+
+	imgMasked, err := imgSquare.CompositeBlend(maskImg, vips.BLEND_MODE_DEST_IN, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer imgMasked.Destroy()
+
+	// Composite works in float, cast back to the format of the image
+	return imgMasked.Cast(img.Format())
+}
+
+// drawBorder draws border along the edge of the mask
+func drawBorder(img *vips.Image, mask string, radius int, border BorderConfig) (*vips.Image, error) {
+	colorName := border.Color
+	if colorName == "" {
+		colorName = "black"
+	}
+
+	color, err := parseColor(colorName)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := fmt.Sprintf(
+		`fill="none" stroke="rgb(%g,%g,%g)" stroke-opacity="%g" stroke-width="%d"`,
+		color[0], color[1], color[2], color[3]/255, border.Width,
+	)
+
+	svg, err := shapeSVG(mask, radius, img.Width(), img.Height(), float64(border.Width)/2, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	borderImg, err := vips.SvgLoad([]byte(svg))
+	if err != nil {
+		return nil, err
+	}
+	defer borderImg.Destroy()
+
+	// Border is drawn in sRGB, convert it to the profile of the image
+	borderMatched, err := matchProfile(borderImg, img, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer borderMatched.Destroy()
+
+	imgComposited, err := img.Composite(borderMatched, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer imgComposited.Destroy()
+
+	if img.HasAlpha() {
+		return imgComposited.Cast(img.Format())
+	}
+
+	// Composite always adds alpha channel, drop it if the original image had none
+	imgWithoutAlpha, err := imgComposited.ExtractBand(0, img.Bands())
+	if err != nil {
+		return nil, err
+	}
+	defer imgWithoutAlpha.Destroy()
+
+	return imgWithoutAlpha.Cast(img.Format())
+}
+
+// applyShape pads, masks and draws border around the image, result is flattened onto the background
+// if alpha is not supported by the output format
+func applyShape(img *vips.Image, profile ProfileConfig, alpha bool) (*vips.Image, error) {
+	background := profile.Background
+	if background == "" {
+		if alpha {
+			background = "transparent"
+		} else {
+			background = "white"
+		}
+	}
+
+	backgroundColor, err := parseColor(background)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := img.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Transparent padding and masks need alpha channel
+	if alpha && !result.HasAlpha() && (profile.Mask != "" || (profile.Padding > 0 && backgroundColor[3] < 255)) {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return img.BandJoinConst(255)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.Padding > 0 {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			color, err := outputColor(backgroundColor, img)
+			if err != nil {
+				return nil, err
+			}
+
+			p := profile.Padding
+			return img.Embed(p, p, img.Width()+2*p, img.Height()+2*p, color)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.Mask != "" {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return maskImage(img, profile.Mask, profile.Radius)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.Border != nil && profile.Border.Width > 0 {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			return drawBorder(img, profile.Mask, profile.Radius, *profile.Border)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !alpha && result.HasAlpha() {
+		result, err = chain(result, func(img *vips.Image) (*vips.Image, error) {
+			color, err := outputColor(backgroundColor, img)
+			if err != nil {
+				return nil, err
+			}
+
+			// Flatten takes background without alpha
+			return img.Flatten(color[:len(color)-1])
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
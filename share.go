@@ -0,0 +1,338 @@
+package sharpei
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+// minIntermediateRatio is how much larger an already resized image should be than the output to be its source,
+// resampling twice with smaller ratios visibly softens the result
+const minIntermediateRatio = 2
+
+// maxMemoryPixels is the largest image kept in memory to be resized several times, prepared images are
+// float LAB with about 12 bytes per pixel. Larger images are recomputed from the source for every output.
+const maxMemoryPixels = 8 * 1000 * 1000
+
+// ProfileFunc receives the output of the profile or the error which occurred while running it.
+// Returning an error stops processing of the remaining profiles.
+type ProfileFunc func(name string, out Output, err error) error
+
+// renditionJob is a single output of a profile
+type renditionJob struct {
+	name    string
+	profile ProfileConfig
+	cfg     TransformConfig
+
+	// Width of the ladder rung, zero if profile has no ladder
+	rung int
+	// Scale relative to the prepared image
+	scale float64
+}
+
+// profileRun collects renditions of the profile until all of them are done
+type profileRun struct {
+	out       Output
+	remaining int
+	failed    bool
+}
+
+// ProcessProfiles runs the profiles on the image sharing the work between them. Profiles which differ only
+// in size, output profile and effects share the geometry, ICC import and adjustments, and every output
+// is resized from the smallest already resized image at least twice as large instead of the full image.
+// fn is called once per profile as soon as all of its renditions are encoded.
+// Computation of the image is stopped when the context is done.
+func ProcessProfiles(ctx context.Context, img *Image, profiles map[string]ProfileConfig, fn ProfileFunc) error {
+	defer killOnDone(ctx, img.img)()
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	runs := make(map[string]*profileRun, len(profiles))
+	groups := make(map[string][]*renditionJob)
+	var keys []string
+
+	for _, name := range names {
+		jobs, err := profileJobs(img, name, profiles[name])
+		if err != nil {
+			if err := fn(name, Output{}, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		runs[name] = &profileRun{remaining: len(jobs)}
+
+		key := prepareKey(jobs[0].cfg)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], jobs...)
+	}
+
+	for _, key := range keys {
+		if err := runGroup(ctx, img, groups[key], runs, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// profileJobs returns outputs of the profile, type same is resolved to the format of the image
+func profileJobs(img *Image, name string, profile ProfileConfig) ([]*renditionJob, error) {
+	if profile.Type == "" || profile.Type == "same" {
+		if img.Format == "" {
+			return nil, errors.Wrap(ErrUnsupportedFormat, "format of the source is unknown, set type of the profile")
+		}
+
+		profile.Type = img.Format
+	}
+
+	widths, err := LadderWidths(profile.Widths, profile.Ladder)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := transformConfig(profile)
+	cfg.Shrink = img.shrink
+
+	if len(widths) == 0 {
+		if cfg.Width < 0 {
+			cfg.Width = 0
+		}
+
+		if cfg.Height < 0 {
+			cfg.Height = 0
+		}
+
+		if cfg.Width == 0 && cfg.Height == 0 {
+			return nil, errors.New("either width or height should be greater than zero")
+		}
+
+		return []*renditionJob{{name: name, profile: profile, cfg: cfg}}, nil
+	}
+
+	jobs := make([]*renditionJob, 0, len(widths))
+
+	for _, width := range widths {
+		rungCfg := cfg
+		rungCfg.Width = width
+		rungCfg.Height = 0
+
+		jobs = append(jobs, &renditionJob{name: name, profile: profile, cfg: rungCfg, rung: width})
+	}
+
+	return jobs, nil
+}
+
+// prepareKey identifies profiles which have the same image before resizing
+func prepareKey(cfg TransformConfig) string {
+	// Prepared image stays in the original colour space only if nothing is done in the LAB PCS space
+	passthrough := cfg.OutputProfile == "same" && cfg.Adjust == nil && len(cfg.Effects) == 0
+
+	cfg.Width = 0
+	cfg.Height = 0
+	cfg.OutputProfile = ""
+	cfg.Effects = nil
+
+	content, _ := json.Marshal(struct {
+		Config      TransformConfig
+		Passthrough bool
+	}{
+		Config:      cfg,
+		Passthrough: passthrough,
+	})
+
+	return string(content)
+}
+
+// runGroup prepares the image once and renders every job of the group from it
+func runGroup(ctx context.Context, img *Image, jobs []*renditionJob, runs map[string]*profileRun, fn ProfileFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	prepared, err := prepareImage(img.img, jobs[0].cfg)
+	if err != nil {
+		for _, job := range jobs {
+			if err := failJob(ctx, job, runs, fn, err); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+	defer prepared.Destroy()
+
+	for _, job := range jobs {
+		scalex := float64(job.cfg.Width) / float64(prepared.Width())
+		scaley := float64(job.cfg.Height) / float64(prepared.Height())
+		job.scale = math.Max(scalex, scaley)
+	}
+
+	// Larger outputs go first, so they can be the sources of smaller ones
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].scale > jobs[j].scale
+	})
+
+	preparedPixels := float64(prepared.Width()) * float64(prepared.Height())
+
+	// fitsMemory returns true if the image of the scale relative to the prepared one can be kept in memory
+	fitsMemory := func(scale float64) bool {
+		return preparedPixels*scale*scale <= maxMemoryPixels
+	}
+
+	// Every job is resized from the smallest previous one which is large enough and fits memory,
+	// or from the prepared image
+	sources := make([]int, len(jobs))
+	isSource := make([]bool, len(jobs))
+	fromPrepared := 0
+
+	for i, job := range jobs {
+		sources[i] = -1
+
+		for j := i - 1; j >= 0; j-- {
+			if jobs[j].scale >= job.scale*minIntermediateRatio && fitsMemory(jobs[j].scale) {
+				sources[i] = j
+				isSource[j] = true
+				break
+			}
+		}
+
+		if sources[i] == -1 {
+			fromPrepared++
+		}
+	}
+
+	// Keep the prepared image in memory if it is resized more than once, so colour import runs only once.
+	// Large images are recomputed from the source instead, so memory stays bounded.
+	if fromPrepared > 1 && fitsMemory(1) {
+		imgMemory, err := prepared.img.CopyMemory()
+		if err != nil {
+			for _, job := range jobs {
+				if err := failJob(ctx, job, runs, fn, err); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		prepared.img.Destroy()
+		prepared.img = imgMemory
+	}
+
+	intermediates := make(map[int]*vips.Image)
+	defer func() {
+		for _, intermediate := range intermediates {
+			intermediate.Destroy()
+		}
+	}()
+
+	for i, job := range jobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if runs[job.name].failed {
+			continue
+		}
+
+		start := time.Now()
+
+		source, sourceScale := prepared.img, 1.0
+		if intermediate, ok := intermediates[sources[i]]; ok {
+			source, sourceScale = intermediate, jobs[sources[i]].scale
+		}
+
+		scale := job.scale / sourceScale
+
+		imgResized, err := source.Resize(scale, scale)
+		if err == nil && isSource[i] {
+			// Keep resized image in memory, it is the source of smaller outputs
+			imgResized, err = chain(imgResized, func(img *vips.Image) (*vips.Image, error) {
+				return img.CopyMemory()
+			})
+			if err == nil {
+				intermediates[i] = imgResized
+			}
+		}
+
+		if err != nil {
+			if err := failJob(ctx, job, runs, fn, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rendition, err := renderJob(prepared, imgResized, job)
+		if !isSource[i] {
+			imgResized.Destroy()
+		}
+
+		if err != nil {
+			if err := failJob(ctx, job, runs, fn, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rendition.Duration = time.Since(start)
+
+		run := runs[job.name]
+		run.out.Renditions = append(run.out.Renditions, *rendition)
+		run.remaining--
+
+		if run.remaining == 0 {
+			if err := fn(job.name, run.out, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renderJob applies effects and output profile to the resized image and encodes it
+func renderJob(prepared *preparedImage, imgResized *vips.Image, job *renditionJob) (*Rendition, error) {
+	imgRendered, err := prepared.render(imgResized, job.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer imgRendered.Destroy()
+
+	rendition, err := encodeImage(job.profile, imgRendered)
+	if err != nil {
+		return nil, err
+	}
+
+	rendition.Rung = job.rung
+
+	return rendition, nil
+}
+
+// failJob reports the error of the profile once, its remaining jobs are skipped.
+// Errors of the killed image are not reported, error of the context is returned instead.
+func failJob(ctx context.Context, job *renditionJob, runs map[string]*profileRun, fn ProfileFunc, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	run := runs[job.name]
+	if run.failed {
+		return nil
+	}
+
+	run.failed = true
+
+	return fn(job.name, Output{}, err)
+}
@@ -0,0 +1,177 @@
+package sharpei
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/meownoid/sharpei/vips"
+)
+
+// maxShrink is the largest factor JPEG decoder can shrink the image on load
+const maxShrink = 8
+
+// profileShrink returns the largest power of two the image of given size can be shrunk on load by,
+// so that the profile still downsizes it. Images trimmed or rotated by arbitrary angle are not shrunk,
+// because the size of their result depends on the content.
+func profileShrink(width int, height int, profile ProfileConfig) int {
+	if width <= 0 || height <= 0 || profile.Trim != nil || math.Mod(profile.Rotate, 90) != 0 {
+		return 1
+	}
+
+	if int(math.Abs(profile.Rotate)/90)%2 == 1 {
+		width, height = height, width
+	}
+
+	if profile.Crop != "" {
+		rect, err := parseCrop(profile.Crop)
+		if err != nil {
+			return 1
+		}
+
+		_, _, width, height = cropRect(rect, width, height, 1)
+		if width <= 0 || height <= 0 {
+			return 1
+		}
+	}
+
+	targetWidth, targetHeight := profile.Width, profile.Height
+
+	widths, err := LadderWidths(profile.Widths, profile.Ladder)
+	if err != nil {
+		return 1
+	}
+
+	if len(widths) > 0 {
+		targetWidth, targetHeight = widths[0], 0
+		for _, w := range widths[1:] {
+			if w > targetWidth {
+				targetWidth = w
+			}
+		}
+	}
+
+	scale := math.Max(float64(targetWidth)/float64(width), float64(targetHeight)/float64(height))
+	if scale <= 0 {
+		return 1
+	}
+
+	shrink := 1
+	for shrink*2 <= maxShrink && scale*float64(shrink*2) <= 1 {
+		shrink *= 2
+	}
+
+	return shrink
+}
+
+// sequentialAccess returns true if the profiles read pixels of the image only once from top to bottom,
+// so it can be decoded sequentially with bounded memory. Several outputs, autorotation, vertical flip,
+// rotation and trimming read the image again or out of order.
+func sequentialAccess(orientation int, profiles []ProfileConfig) bool {
+	if len(profiles) != 1 || orientation > 1 {
+		return false
+	}
+
+	profile := profiles[0]
+
+	if profile.Trim != nil || profile.Flip || math.Mod(profile.Rotate, 360) != 0 {
+		return false
+	}
+
+	widths, err := LadderWidths(profile.Widths, profile.Ladder)
+
+	return err == nil && len(widths) <= 1
+}
+
+// OpenForProfiles loads the image from the file like Open, JPEG and WebP images are shrunk on load
+// as much as the largest output of the profiles allows, which is much faster than decoding them fully.
+// Image of a single output which reads it once is streamed from the file, so it should be processed
+// only once and only with these profiles. Limits are checked before the image is decoded.
+func OpenForProfiles(path string, limits LimitsConfig, profiles ...ProfileConfig) (*Image, error) {
+	initVips()
+
+	failOn, err := limits.failOn()
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.MaxInputBytes > 0 {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := limits.checkInputBytes(stat.Size()); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := vips.NewFromFile(path, vips.ACCESS_SEQUENTIAL, failOn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limits.checkHeader(header); err != nil {
+		header.Destroy()
+		return nil, err
+	}
+
+	width, height := header.Width(), header.Height()
+
+	orientation, err := header.PropertyInt("orientation")
+	if err != nil {
+		orientation = 1
+	}
+
+	// Profiles are applied to the autorotated image
+	if orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+
+	header.Destroy()
+
+	shrink := 0
+	for _, profile := range profiles {
+		s := profileShrink(width, height, profile)
+		if shrink == 0 || s < shrink {
+			shrink = s
+		}
+	}
+
+	if shrink == 0 {
+		shrink = 1
+	}
+
+	access := vips.ACCESS_RANDOM
+	if sequentialAccess(orientation, profiles) {
+		access = vips.ACCESS_SEQUENTIAL
+	}
+
+	return openShrink(path, access, shrink, failOn)
+}
+
+// openShrink loads the image from the file shrinking it on load by the factor if the format supports it
+func openShrink(path string, access int, shrink int, failOn int) (*Image, error) {
+	initVips()
+
+	img, applied, err := vips.NewFromFileShrink(path, access, shrink, failOn)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Destroy()
+
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	if !IsImage(path) {
+		format = loaderFormat(img)
+	}
+
+	result, err := newImage(img, format)
+	if err != nil {
+		return nil, err
+	}
+
+	result.shrink = applied
+
+	return result, nil
+}
@@ -1,11 +1,13 @@
-package main
+package sharpei
 
 import (
-	"errors"
 	"math"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
 )
 
 var profileMapping = map[string]string{
@@ -15,9 +17,15 @@ var profileMapping = map[string]string{
 	"srgb-v4": "data/sRGB_v4_ICC_preference.icc",
 }
 
-var profileCache = map[string][]byte{}
+var (
+	profileCache   = map[string][]byte{}
+	profileCacheMu sync.Mutex
+)
 
 func getProfile(name string) ([]byte, error) {
+	profileCacheMu.Lock()
+	defer profileCacheMu.Unlock()
+
 	if profile, ok := profileCache[name]; ok {
 		return profile, nil
 	}
@@ -35,93 +43,190 @@ func getProfile(name string) ([]byte, error) {
 
 	profile, err := vips.LoadProfile(name)
 	if err != nil {
-		return nil, err
+		if _, statErr := os.Stat(name); os.IsNotExist(statErr) {
+			return nil, errors.Wrapf(ErrProfileNotFound, "%s", name)
+		}
+
+		return nil, errors.Wrapf(err, "load ICC profile %s", name)
 	}
 
 	profileCache[name] = profile
 	return profile, nil
 }
 
-type TransformConfig struct {
-	Width         int
-	Height        int
-	InputProfile  string
-	OutputProfile string
+// defaultProfile returns name of the profile which is assumed for images without embedded one
+func defaultProfile(img *vips.Image) string {
+	switch img.Interpretation() {
+	case vips.INTERPRETATION_B_W, vips.INTERPRETATION_GREY16:
+		return "gray"
+	default:
+		return "srgb"
+	}
 }
 
-func TransformImage(img *vips.Image, cfg TransformConfig) (*vips.Image, error) {
-	if cfg.Width < 0 {
-		cfg.Width = 0
+// importImage imports image to the LAB PCS space. If image has no embedded profile,
+// input profile (or the default one) is attached first and its name is returned.
+func importImage(img *vips.Image, inputProfile string) (*vips.Image, string, error) {
+	if img.IsPropertySet("icc-profile-data") {
+		imgImported, err := img.ICCImport(vips.INTENT_RELATIVE)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return imgImported, "", nil
 	}
 
-	if cfg.Height < 0 {
-		cfg.Height = 0
+	if inputProfile == "" {
+		inputProfile = defaultProfile(img)
 	}
 
-	if cfg.Width == 0 && cfg.Height == 0 {
-		return nil, errors.New("either width or height should be greater than zero")
+	profile, err := getProfile(inputProfile)
+	if err != nil {
+		return nil, "", err
 	}
 
-	// Calculate scale
-	scalex := float64(cfg.Width) / float64(img.Width())
-	scaley := float64(cfg.Height) / float64(img.Height())
-	scale := math.Max(scalex, scaley)
+	imgWithICCProfile, err := img.Copy()
+	if err != nil {
+		return nil, "", err
+	}
+	defer imgWithICCProfile.Destroy()
 
-	isEmbeddedICC := img.IsPropertySet("icc-profile-data")
+	imgWithICCProfile.SetPropertyBlob("icc-profile-data", profile)
 
-	if cfg.OutputProfile == "same" && isEmbeddedICC {
-		// Resize image in the original color space
-		imgResized, err := img.Resize(scale, scale)
-		if err != nil {
-			return nil, err
-		}
+	imgImported, err := imgWithICCProfile.ICCImport(vips.INTENT_RELATIVE)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return imgImported, inputProfile, nil
+}
 
-		return imgResized, nil
+// exportImage exports image from the LAB PCS space to the given ICC profile
+func exportImage(img *vips.Image, profile []byte) (*vips.Image, error) {
+	imgCopy, err := img.Copy()
+	if err != nil {
+		return nil, err
 	}
+	defer imgCopy.Destroy()
 
-	if cfg.InputProfile == "" {
-		switch img.Interpretation() {
-		case vips.INTERPRETATION_B_W, vips.INTERPRETATION_GREY16:
-			cfg.InputProfile = "gray"
-		default:
-			cfg.InputProfile = "srgb"
-		}
+	imgCopy.SetPropertyBlob("icc-profile-data", profile)
+
+	return imgCopy.ICCExport(vips.INTENT_RELATIVE, 8)
+}
+
+type TransformConfig struct {
+	Width          int
+	Height         int
+	InputProfile   string
+	OutputProfile  string
+	Rotate         float64
+	Flip           bool
+	Flop           bool
+	Crop           string
+	Background     string
+	Trim           bool
+	TrimThreshold  float64
+	TrimBackground string
+	TrimPadding    int
+	Adjust         *AdjustConfig
+	Effects        []EffectConfig
+
+	// Factor by which the image was shrunk on load, pixel values of the crop are divided by it
+	Shrink int
+}
+
+func (cfg TransformConfig) shrink() int {
+	if cfg.Shrink < 1 {
+		return 1
 	}
 
-	imgWithICCProfile := img
-	profileAttached := ""
+	return cfg.Shrink
+}
 
-	// If image has no attached profile, load the default one and embed it into the image
-	if !isEmbeddedICC {
-		profileAttached = cfg.InputProfile
+// preparedImage is an image with geometric operations applied, imported to the LAB PCS space and adjusted,
+// it can be resized and rendered multiple times
+type preparedImage struct {
+	img             *vips.Image
+	profileAttached string
+	defaultProfile  string
 
-		inputProfile, err := getProfile(cfg.InputProfile)
-		if err != nil {
-			return nil, err
-		}
+	// Image was not imported and stays in the original colour space
+	passthrough bool
+}
 
-		imgWithICCProfile, err = img.Copy()
-		if err != nil {
-			return nil, err
-		}
-		defer imgWithICCProfile.Destroy()
+func (p *preparedImage) Width() int {
+	return p.img.Width()
+}
 
-		imgWithICCProfile.SetPropertyBlob("icc-profile-data", inputProfile)
-	}
+func (p *preparedImage) Height() int {
+	return p.img.Height()
+}
 
-	// Import image to the LAB PCS space using embedded profile
-	imgImported, err := imgWithICCProfile.ICCImport(vips.INTENT_RELATIVE)
+func (p *preparedImage) Destroy() {
+	p.img.Destroy()
+}
+
+// prepareImage applies all operations which precede resizing
+func prepareImage(img *vips.Image, cfg TransformConfig) (*preparedImage, error) {
+	// Rotate, flip, crop and trim image before resizing
+	imgGeometry, err := applyGeometry(img, cfg)
 	if err != nil {
 		return nil, err
 	}
-	defer imgImported.Destroy()
 
-	// Resize image in the LAB PCS space
-	imgResized, err := imgImported.Resize(scale, scale)
+	prepared := &preparedImage{
+		defaultProfile: defaultProfile(imgGeometry),
+	}
+
+	isEmbeddedICC := imgGeometry.IsPropertySet("icc-profile-data")
+
+	if cfg.OutputProfile == "same" && isEmbeddedICC && cfg.Adjust == nil && len(cfg.Effects) == 0 {
+		// Resize image in the original color space
+		prepared.img = imgGeometry
+		prepared.passthrough = true
+
+		return prepared, nil
+	}
+	defer imgGeometry.Destroy()
+
+	// Import image to the LAB PCS space using embedded or input profile
+	imgImported, profileAttached, err := importImage(imgGeometry, cfg.InputProfile)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "colour import")
+	}
+
+	// Adjust tone and colour in the LAB PCS space where it is perceptually uniform
+	if cfg.Adjust != nil {
+		imgImported, err = chain(imgImported, func(img *vips.Image) (*vips.Image, error) {
+			return adjustImage(img, *cfg.Adjust)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prepared.img = imgImported
+	prepared.profileAttached = profileAttached
+
+	return prepared, nil
+}
+
+// render applies effects to the resized prepared image and exports it to the output ICC profile
+func (p *preparedImage) render(imgResized *vips.Image, cfg TransformConfig) (*vips.Image, error) {
+	if p.passthrough {
+		return imgResized.Copy()
+	}
+
+	// Apply effects in the LAB PCS space after resizing
+	if len(cfg.Effects) > 0 {
+		imgEffects, err := applyEffects(imgResized, cfg.Effects)
+		if err != nil {
+			return nil, err
+		}
+		defer imgEffects.Destroy()
+
+		imgResized = imgEffects
 	}
-	defer imgResized.Destroy()
 
 	imgResizedCopy, err := imgResized.Copy()
 	if err != nil {
@@ -130,16 +235,11 @@ func TransformImage(img *vips.Image, cfg TransformConfig) (*vips.Image, error) {
 	defer imgResizedCopy.Destroy()
 
 	if cfg.OutputProfile == "" || cfg.OutputProfile == "same" {
-		switch img.Interpretation() {
-		case vips.INTERPRETATION_B_W, vips.INTERPRETATION_GREY16:
-			cfg.OutputProfile = "gray"
-		default:
-			cfg.OutputProfile = "srgb"
-		}
+		cfg.OutputProfile = p.defaultProfile
 	}
 
 	// Load output profile and attach it to the image
-	if cfg.OutputProfile != profileAttached {
+	if cfg.OutputProfile != p.profileAttached {
 		outputProfile, err := getProfile(cfg.OutputProfile)
 		if err != nil {
 			return nil, err
@@ -151,8 +251,42 @@ func TransformImage(img *vips.Image, cfg TransformConfig) (*vips.Image, error) {
 	// Export image to the output ICC profile
 	imgExported, err := imgResizedCopy.ICCExport(vips.INTENT_RELATIVE, 8)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "colour export")
 	}
 
 	return imgExported, nil
 }
+
+func TransformImage(img *vips.Image, cfg TransformConfig) (*vips.Image, error) {
+	if cfg.Width < 0 {
+		cfg.Width = 0
+	}
+
+	if cfg.Height < 0 {
+		cfg.Height = 0
+	}
+
+	if cfg.Width == 0 && cfg.Height == 0 {
+		return nil, errors.New("either width or height should be greater than zero")
+	}
+
+	prepared, err := prepareImage(img, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer prepared.Destroy()
+
+	// Calculate scale
+	scalex := float64(cfg.Width) / float64(prepared.Width())
+	scaley := float64(cfg.Height) / float64(prepared.Height())
+	scale := math.Max(scalex, scaley)
+
+	// Resize image in the LAB PCS space
+	imgResized, err := prepared.img.Resize(scale, scale)
+	if err != nil {
+		return nil, err
+	}
+	defer imgResized.Destroy()
+
+	return prepared.render(imgResized, cfg)
+}
@@ -0,0 +1,54 @@
+package sharpei
+
+import (
+	"os"
+
+	"github.com/meownoid/sharpei/vips"
+)
+
+// Verify fully decodes the image from the file to find corruption, like truncated files which are otherwise
+// decoded with the grey bottom. Decoding fails on problems of the fail_on level of the limits, error by default.
+// Truncated files always fail, even if fail_on of the limits is none.
+func Verify(path string, limits LimitsConfig) error {
+	initVips()
+
+	if limits.FailOn == "" {
+		limits.FailOn = "error"
+	}
+
+	failOn, err := limits.failOn()
+	if err != nil {
+		return err
+	}
+
+	// Levels are ordered by severity, none is the most permissive
+	if failOn < vips.FAIL_ON_TRUNCATED {
+		failOn = vips.FAIL_ON_TRUNCATED
+	}
+
+	if limits.MaxInputBytes > 0 {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if err := limits.checkInputBytes(stat.Size()); err != nil {
+			return err
+		}
+	}
+
+	// Image is read once from top to bottom, so memory is bounded
+	img, err := vips.NewFromFile(path, vips.ACCESS_SEQUENTIAL, failOn)
+	if err != nil {
+		return err
+	}
+	defer img.Destroy()
+
+	if err := limits.checkHeader(img); err != nil {
+		return err
+	}
+
+	_, err = img.Avg()
+
+	return err
+}
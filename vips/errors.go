@@ -0,0 +1,81 @@
+package vips
+
+// #include <vips/vips.h>
+import "C"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors of vips operations match these errors with errors.Is according to the libvips message
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrCorruptImage      = errors.New("corrupt image")
+	ErrOutOfMemory       = errors.New("out of memory")
+	ErrBadProfile        = errors.New("bad ICC profile")
+)
+
+// Error is an error of the vips operation
+type Error struct {
+	// Name of the operation, like resize
+	Op string
+	// Message of libvips, it can span multiple lines
+	Message string
+
+	kind error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether the error is of the kind of target, one of the Err* errors of the package
+func (e *Error) Is(target error) bool {
+	return e.kind != nil && e.kind == target
+}
+
+// newError returns error of the operation with the message from the libvips error buffer, buffer is cleared
+func newError(op string) error {
+	defer C.vips_error_clear()
+
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	if message == "" {
+		message = fmt.Sprintf("unknown error in vips function %s", op)
+	}
+
+	return &Error{
+		Op:      op,
+		Message: message,
+		kind:    errorKind(op, message),
+	}
+}
+
+// errorKind guesses kind of the error, libvips has no error codes and reports errors as text only
+func errorKind(op string, message string) error {
+	message = strings.ToLower(message)
+
+	contains := func(substrings ...string) bool {
+		for _, s := range substrings {
+			if strings.Contains(message, s) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	switch {
+	case contains("out of memory", "unable to allocate", "memory allocation failed"):
+		return ErrOutOfMemory
+	case op == "profile_load" || op == "icc_import" || op == "icc_export" || contains("icc", "profile"):
+		return ErrBadProfile
+	case contains("not a known", "unsupported", "no known"):
+		return ErrUnsupportedFormat
+	case contains("premature end", "corrupt", "truncated", "not a jpeg", "read error", "unable to read",
+		"out of order read", "end of file", "unexpected end", "crc error", "libpng error", "bad huffman"):
+		return ErrCorruptImage
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package vips
+
+// #include <stdint.h>
+// #include <vips/vips.h>
+import "C"
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// Readers and writers can not be passed to C, so sources and targets refer to them by handles
+var (
+	streamsMu  sync.Mutex
+	streams    = map[uintptr]*stream{}
+	nextStream uintptr
+)
+
+// maxEmptyReads is the number of reads without data and error after which the reader is considered broken
+const maxEmptyReads = 100
+
+type stream struct {
+	r io.Reader
+	w io.Writer
+
+	// First error of the writer, vips reports only that writing has failed
+	err error
+}
+
+func registerStream(s *stream) uintptr {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	nextStream++
+	streams[nextStream] = s
+
+	return nextStream
+}
+
+func lookupStream(handle C.uintptr_t) *stream {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	return streams[uintptr(handle)]
+}
+
+//export goSourceRead
+func goSourceRead(handle C.uintptr_t, buf unsafe.Pointer, length C.gint64) C.gint64 {
+	s := lookupStream(handle)
+	if s == nil || s.r == nil {
+		return -1
+	}
+
+	p := view(buf, int(length))
+
+	// Reader which keeps returning nothing without an error is broken, like in bufio
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := s.r.Read(p)
+		if n > 0 {
+			return C.gint64(n)
+		}
+
+		if err == io.EOF {
+			return 0
+		}
+
+		if err != nil {
+			return -1
+		}
+	}
+
+	// Reading has failed with io.ErrNoProgress
+	return -1
+}
+
+//export goSourceSeek
+func goSourceSeek(handle C.uintptr_t, offset C.gint64, whence C.int) C.gint64 {
+	s := lookupStream(handle)
+	if s == nil {
+		return -1
+	}
+
+	seeker, ok := s.r.(io.Seeker)
+	if !ok {
+		return -1
+	}
+
+	position, err := seeker.Seek(int64(offset), int(whence))
+	if err != nil {
+		return -1
+	}
+
+	return C.gint64(position)
+}
+
+//export goTargetWrite
+func goTargetWrite(handle C.uintptr_t, data unsafe.Pointer, length C.gint64) C.gint64 {
+	s := lookupStream(handle)
+	if s == nil || s.w == nil {
+		return -1
+	}
+
+	n, err := s.w.Write(view(data, int(length)))
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+
+		return -1
+	}
+
+	return C.gint64(n)
+}
+
+//export goStreamRelease
+func goStreamRelease(handle C.uintptr_t) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	delete(streams, uintptr(handle))
+}
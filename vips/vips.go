@@ -4,11 +4,13 @@ package vips
 // #include "vips.h"
 import "C"
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"runtime"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -16,7 +18,10 @@ func Init(name string) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	if err := C.vips_init(C.CString(name)); err != 0 {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	if err := C.vips_init(cName); err != 0 {
 		C.vips_shutdown()
 		panic("failed to initialize vips")
 	}
@@ -28,20 +33,67 @@ func Shutdown() {
 	C.vips_shutdown()
 }
 
-func getError(name string) string {
-	defer C.vips_error_clear()
+type Image struct {
+	vi *C.VipsImage
+}
+
+var (
+	// Images which are not destroyed yet
+	liveImages int64
+	// Non-zero if images are released by finalizers
+	finalizers int32
+)
+
+// SetFinalizers enables or disables releasing of images which are garbage collected without Destroy.
+// It is a safety net for long-running programs, images should still be destroyed as soon as they are not needed.
+func SetFinalizers(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&finalizers, 1)
+	} else {
+		atomic.StoreInt32(&finalizers, 0)
+	}
+}
 
-	maybeError := C.GoString(C.vips_error_buffer())
+// newImage wraps the image. Methods keep the wrapper alive until C calls return,
+// so the finalizer can not release the image while it is used.
+func newImage(vi *C.VipsImage) *Image {
+	img := &Image{vi: vi}
+	atomic.AddInt64(&liveImages, 1)
 
-	if len(maybeError) > 0 {
-		return maybeError
+	if atomic.LoadInt32(&finalizers) != 0 {
+		runtime.SetFinalizer(img, (*Image).Destroy)
 	}
 
-	return fmt.Sprintf("unknown error in vips function %s", name)
+	return img
 }
 
-type Image struct {
-	vi *C.VipsImage
+// MemoryStats are memory and allocation counters of libvips
+type MemoryStats struct {
+	// Bytes of pixel buffers currently allocated
+	Mem int64
+	// Largest number of bytes allocated at once
+	MemHighwater int64
+	// Number of active pixel buffer allocations
+	Allocs int
+	// Number of open files
+	Files int
+	// Number of images which are not destroyed yet
+	Images int64
+	// Number of live vips objects, including images, sources and operations
+	Objects int
+}
+
+// Stats returns current memory and allocation counters, they should not grow when
+// the same operations are repeated and all images are destroyed
+func Stats() MemoryStats {
+	return MemoryStats{
+		Mem:          int64(C.vips_tracked_get_mem()),
+		MemHighwater: int64(C.vips_tracked_get_mem_highwater()),
+		Allocs:       int(C.vips_tracked_get_allocs()),
+		Files:        int(C.vips_tracked_get_files()),
+		Images:       atomic.LoadInt64(&liveImages),
+		Objects:      int(C.live_objects()),
+	}
 }
 
 const (
@@ -76,82 +128,203 @@ const (
 	INTENT_LAST       = int(C.VIPS_INTENT_LAST)
 )
 
+const (
+	FORMAT_NOTSET    = int(C.VIPS_FORMAT_NOTSET)
+	FORMAT_UCHAR     = int(C.VIPS_FORMAT_UCHAR)
+	FORMAT_CHAR      = int(C.VIPS_FORMAT_CHAR)
+	FORMAT_USHORT    = int(C.VIPS_FORMAT_USHORT)
+	FORMAT_SHORT     = int(C.VIPS_FORMAT_SHORT)
+	FORMAT_UINT      = int(C.VIPS_FORMAT_UINT)
+	FORMAT_INT       = int(C.VIPS_FORMAT_INT)
+	FORMAT_FLOAT     = int(C.VIPS_FORMAT_FLOAT)
+	FORMAT_COMPLEX   = int(C.VIPS_FORMAT_COMPLEX)
+	FORMAT_DOUBLE    = int(C.VIPS_FORMAT_DOUBLE)
+	FORMAT_DPCOMPLEX = int(C.VIPS_FORMAT_DPCOMPLEX)
+	FORMAT_LAST      = int(C.VIPS_FORMAT_LAST)
+)
+
+const (
+	ACCESS_RANDOM     = int(C.VIPS_ACCESS_RANDOM)
+	ACCESS_SEQUENTIAL = int(C.VIPS_ACCESS_SEQUENTIAL)
+)
+
+const (
+	FAIL_ON_NONE      = int(C.VIPS_FAIL_ON_NONE)
+	FAIL_ON_TRUNCATED = int(C.VIPS_FAIL_ON_TRUNCATED)
+	FAIL_ON_ERROR     = int(C.VIPS_FAIL_ON_ERROR)
+	FAIL_ON_WARNING   = int(C.VIPS_FAIL_ON_WARNING)
+)
+
+const (
+	ANGLE_D0   = int(C.VIPS_ANGLE_D0)
+	ANGLE_D90  = int(C.VIPS_ANGLE_D90)
+	ANGLE_D180 = int(C.VIPS_ANGLE_D180)
+	ANGLE_D270 = int(C.VIPS_ANGLE_D270)
+	ANGLE_LAST = int(C.VIPS_ANGLE_LAST)
+)
+
+const (
+	DIRECTION_HORIZONTAL = int(C.VIPS_DIRECTION_HORIZONTAL)
+	DIRECTION_VERTICAL   = int(C.VIPS_DIRECTION_VERTICAL)
+	DIRECTION_LAST       = int(C.VIPS_DIRECTION_LAST)
+)
+
+const (
+	KERNEL_NEAREST  = int(C.VIPS_KERNEL_NEAREST)
+	KERNEL_LINEAR   = int(C.VIPS_KERNEL_LINEAR)
+	KERNEL_CUBIC    = int(C.VIPS_KERNEL_CUBIC)
+	KERNEL_MITCHELL = int(C.VIPS_KERNEL_MITCHELL)
+	KERNEL_LANCZOS2 = int(C.VIPS_KERNEL_LANCZOS2)
+	KERNEL_LANCZOS3 = int(C.VIPS_KERNEL_LANCZOS3)
+	KERNEL_LAST     = int(C.VIPS_KERNEL_LAST)
+)
+
+const (
+	BLEND_MODE_OVER      = int(C.VIPS_BLEND_MODE_OVER)
+	BLEND_MODE_IN        = int(C.VIPS_BLEND_MODE_IN)
+	BLEND_MODE_OUT       = int(C.VIPS_BLEND_MODE_OUT)
+	BLEND_MODE_ATOP      = int(C.VIPS_BLEND_MODE_ATOP)
+	BLEND_MODE_DEST_OVER = int(C.VIPS_BLEND_MODE_DEST_OVER)
+	BLEND_MODE_DEST_IN   = int(C.VIPS_BLEND_MODE_DEST_IN)
+	BLEND_MODE_DEST_OUT  = int(C.VIPS_BLEND_MODE_DEST_OUT)
+)
+
 func (img *Image) Copy() (*Image, error) {
+	defer runtime.KeepAlive(img)
+
 	var out *C.VipsImage
 
 	if s := C.copy(img.vi, &out); s != 0 {
-		return nil, errors.New(getError("copy"))
+		return nil, newError("copy")
 	}
 
-	return &Image{vi: out}, nil
+	return newImage(out), nil
 }
 
+// CopyMemory computes the image and returns its copy stored in memory,
+// so it can be used as a source for multiple operations without recomputing
+func (img *Image) CopyMemory() (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	if s := C.copy_memory(img.vi, &out); s != 0 {
+		return nil, newError("copy_memory")
+	}
+
+	return newImage(out), nil
+}
+
+// Destroy releases the image, it is safe to call it more than once
 func (img *Image) Destroy() {
+	if img.vi == nil {
+		return
+	}
+
+	runtime.SetFinalizer(img, nil)
 	C.g_object_unref(C.gpointer(img.vi))
+	img.vi = nil
+	atomic.AddInt64(&liveImages, -1)
+}
+
+// Kill stops computation of the image, pipelines reading it fail. It can be called from another goroutine.
+func (img *Image) Kill() {
+	defer runtime.KeepAlive(img)
+
+	C.vips_image_set_kill(img.vi, C.TRUE)
 }
 
 // Width returns image width, in pixels
 func (img *Image) Width() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Xsize)
 }
 
 // Height returns image height, in pixels
 func (img *Image) Height() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Ysize)
 }
 
 // Bands returns number of image bands
 func (img *Image) Bands() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Bands)
 }
 
 // Format returns pixel format
 func (img *Image) Format() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.BandFmt)
 }
 
 // Coding returns pixel coding
 func (img *Image) Coding() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Coding)
 }
 
 // Interpretation returns pixel interpretation
 func (img *Image) Interpretation() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Type)
 }
 
 // XRes returns horizontal pixels per millimetre
 func (img *Image) XRes() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Xres)
 }
 
 // YRes returns vertical pixels per millimetre
 func (img *Image) YRes() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Yres)
 }
 
 // XOffset returns image origin x coordinate, in pixels
 func (img *Image) XOffset() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Xoffset)
 }
 
 // YOffset returns image origin y coordinate, in pixels
 func (img *Image) YOffset() int {
+	defer runtime.KeepAlive(img)
+
 	return int(img.vi.Yoffset)
 }
 
 // Filename returns original image filename
 func (img *Image) Filename() string {
+	defer runtime.KeepAlive(img)
+
 	return C.GoString(img.vi.filename)
 }
 
 // IsPropertySet returns true if property with that name is set on the image, false otherwise
 func (img *Image) IsPropertySet(name string) bool {
-	return C.vips_image_get_typeof(img.vi, C.CString(name)) != 0
+	defer runtime.KeepAlive(img)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	return C.vips_image_get_typeof(img.vi, cName) != 0
 }
 
 // Properties returns list of names of all properties of an image
 func (img *Image) Properties() []string {
+	defer runtime.KeepAlive(img)
+
 	fields := C.image_get_fields(img.vi)
 	defer C.g_strfreev(fields)
 
@@ -171,7 +344,12 @@ func (img *Image) Properties() []string {
 }
 
 func (img *Image) RemoveProperty(name string) error {
-	status := C.image_remove(img.vi, C.CString(name))
+	defer runtime.KeepAlive(img)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	status := C.image_remove(img.vi, cName)
 
 	if status == 0 {
 		return fmt.Errorf("no metadata with name %s", name)
@@ -182,214 +360,819 @@ func (img *Image) RemoveProperty(name string) error {
 
 // PropertyString returns string value of the property with given name
 func (img *Image) PropertyString(name string) string {
+	defer runtime.KeepAlive(img)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
 	var out *C.char
-	C.vips_image_get_as_string(
-		img.vi,
-		C.CString(name),
-		&out,
-	)
+
+	if status := C.vips_image_get_as_string(img.vi, cName, &out); status != 0 {
+		C.vips_error_clear()
+		return ""
+	}
+	defer C.g_free(C.gpointer(out))
 
 	return C.GoString(out)
 }
 
+// PropertyInt returns integer value of the property with given name
+func (img *Image) PropertyInt(name string) (int, error) {
+	defer runtime.KeepAlive(img)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var out C.int
+
+	if status := C.vips_image_get_int(img.vi, cName, &out); status != 0 {
+		return 0, newError("image_get_int")
+	}
+
+	return int(out), nil
+}
+
 func (img *Image) SetPropertyBlob(name string, data []byte) {
+	defer runtime.KeepAlive(img)
+
+	if len(data) == 0 {
+		return
+	}
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
 	C.vips_image_set_blob_copy(
 		img.vi,
-		C.CString(name),
+		cName,
 		unsafe.Pointer(&data[0]),
 		C.size_t(len(data)),
 	)
 }
 
+// PropertyBlob returns a copy of the blob value of the property with given name
+func (img *Image) PropertyBlob(name string) ([]byte, error) {
+	defer runtime.KeepAlive(img)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var data unsafe.Pointer
+	var length C.size_t
+
+	status := C.vips_image_get_blob(
+		img.vi,
+		cName,
+		&data,
+		&length,
+	)
+
+	if status != 0 {
+		return nil, newError("vips_image_get_blob")
+	}
+
+	return C.GoBytes(data, C.int(length)), nil
+}
+
+// Avg returns average of all pixels of all bands, every pixel of the image is computed
+func (img *Image) Avg() (float64, error) {
+	defer runtime.KeepAlive(img)
+
+	var out C.double
+
+	if status := C.avg(img.vi, &out); status != 0 {
+		return 0, newError("avg")
+	}
+
+	return float64(out), nil
+}
+
+// HasAlpha returns true if the last band of the image looks like an alpha channel
+func (img *Image) HasAlpha() bool {
+	defer runtime.KeepAlive(img)
+
+	return C.vips_image_hasalpha(img.vi) != 0
+}
+
+// Decode reads the whole image and decodes it
 func Decode(r io.Reader) (*Image, error) {
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
 
-	vi := C.image_new_from_buffer(
-		unsafe.Pointer(&buf[0]),
-		C.size_t(len(buf)),
-		C.CString(""),
+	return DecodeStream(bytes.NewReader(buf), FAIL_ON_NONE)
+}
+
+// DecodeStream decodes the image reading it from r on demand, so r should stay open while the image
+// and images created from it are used. If r implements io.Seeker, loaders can seek instead of buffering.
+// Decoding fails on problems of the source of the failOn level or more severe, one of the FAIL_ON_* constants.
+func DecodeStream(r io.Reader, failOn int) (*Image, error) {
+	_, seekable := r.(io.Seeker)
+
+	optionString := C.CString("")
+	defer C.free(unsafe.Pointer(optionString))
+
+	vi := C.image_new_from_stream(
+		C.uintptr_t(registerStream(&stream{r: r})),
+		C.int(btoi(seekable)),
+		optionString,
+		C.int(failOn),
 	)
 	if vi == nil {
-		return nil, errors.New(getError("image_new_from_buffer"))
+		return nil, newError("image_new_from_stream")
+	}
+
+	return newImage(vi), nil
+}
+
+// NewFromFile loads the image from the file, pixels are decoded on demand. With ACCESS_SEQUENTIAL
+// large images are decoded with bounded memory, but the image can be read only once from top to bottom.
+// Decoding fails on problems of the file of the failOn level or more severe, one of the FAIL_ON_* constants.
+func NewFromFile(path string, access int, failOn int) (*Image, error) {
+	filename := C.CString(path)
+	defer C.free(unsafe.Pointer(filename))
+
+	vi := C.image_new_from_file(filename, C.int(access), C.int(failOn))
+	if vi == nil {
+		return nil, newError("image_new_from_file")
+	}
+
+	return newImage(vi), nil
+}
+
+// NewFromFileShrink loads the image from the file like NewFromFile, JPEG and WebP images are decoded
+// at resolution reduced by the shrink factor. Factor which was applied is returned, it is 1 for other formats.
+func NewFromFileShrink(path string, access int, shrink int, failOn int) (*Image, int, error) {
+	filename := C.CString(path)
+	defer C.free(unsafe.Pointer(filename))
+
+	var applied C.int
+
+	vi := C.image_new_from_file_shrink(filename, C.int(access), C.int(shrink), C.int(failOn), &applied)
+	if vi == nil {
+		return nil, 0, newError("image_new_from_file_shrink")
 	}
 
-	return &Image{vi: vi}, nil
+	return newImage(vi), int(applied), nil
+}
+
+// encode writes output of the save function to w without buffering the whole file
+func encode(w io.Writer, name string, save func(target *C.VipsTarget) C.int) error {
+	s := &stream{w: w}
+
+	target := C.target_new(C.uintptr_t(registerStream(s)))
+	defer C.g_object_unref(C.gpointer(target))
+
+	if status := save(target); status != 0 {
+		// Error of the writer is more useful than the vips one
+		if s.err != nil {
+			C.vips_error_clear()
+			return s.err
+		}
+
+		return newError(name)
+	}
+
+	return nil
+}
+
+// EncodeTo encodes the image in the format given by the suffix with options, like ".webp[Q=80]"
+func (img *Image) EncodeTo(w io.Writer, suffix string) error {
+	defer runtime.KeepAlive(img)
+
+	cSuffix := C.CString(suffix)
+	defer C.free(unsafe.Pointer(cSuffix))
+
+	return encode(w, "write_to_target", func(target *C.VipsTarget) C.int {
+		return C.write_to_target(img.vi, target, cSuffix)
+	})
 }
 
 func (img *Image) EncodeJPEG(w io.Writer, quality int) error {
-	var b unsafe.Pointer
-	var s C.size_t
+	defer runtime.KeepAlive(img)
 
-	status := C.jpegsave_buffer(
+	return encode(w, "jpegsave_target", func(target *C.VipsTarget) C.int {
+		return C.jpegsave_target(img.vi, target, C.int(quality))
+	})
+}
+
+func (img *Image) EncodePNG(w io.Writer, compression int) error {
+	defer runtime.KeepAlive(img)
+
+	return encode(w, "pngsave_target", func(target *C.VipsTarget) C.int {
+		return C.pngsave_target(img.vi, target, C.int(compression))
+	})
+}
+
+func (img *Image) EncodeTIFF(w io.Writer) error {
+	defer runtime.KeepAlive(img)
+
+	return encode(w, "tiffsave_target", func(target *C.VipsTarget) C.int {
+		return C.tiffsave_target(img.vi, target)
+	})
+}
+
+func (img *Image) EncodeWEBP(w io.Writer, quality int, loseless bool) error {
+	defer runtime.KeepAlive(img)
+
+	return encode(w, "webpsave_target", func(target *C.VipsTarget) C.int {
+		return C.webpsave_target(img.vi, target, C.int(quality), C.int(btoi(loseless)))
+	})
+}
+
+func (img *Image) Resize(xscale float64, yscale float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.resize(
 		img.vi,
-		&b,
-		&s,
-		C.int(quality),
+		&out,
+		C.double(xscale),
+		C.double(yscale),
 	)
 
 	if status != 0 {
-		return errors.New(getError("jpegsave_buffer"))
+		return nil, newError("resize")
 	}
-	defer C.g_free(C.gpointer(b))
 
-	_, err := w.Write(view(b, int(s)))
-	if err != nil {
-		return err
+	return newImage(out), nil
+}
+
+// ResizeKernel resizes image like Resize, but uses the given interpolation kernel, one of the KERNEL_* constants
+func (img *Image) ResizeKernel(xscale float64, yscale float64, kernel int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.resize_kernel(
+		img.vi,
+		&out,
+		C.double(xscale),
+		C.double(yscale),
+		C.int(kernel),
+	)
+
+	if status != 0 {
+		return nil, newError("resize_kernel")
 	}
 
-	return nil
+	return newImage(out), nil
 }
 
-func (img *Image) EncodePNG(w io.Writer, compression int) error {
-	var b unsafe.Pointer
-	var s C.size_t
+// GaussBlur blurs image with the gaussian of the given standard deviation
+func (img *Image) GaussBlur(sigma float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
 
-	status := C.pngsave_buffer(
+	var out *C.VipsImage
+
+	status := C.gaussblur(
 		img.vi,
-		&b,
-		&s,
-		C.int(compression),
+		&out,
+		C.double(sigma),
 	)
 
 	if status != 0 {
-		return errors.New(getError("pngsave_buffer"))
+		return nil, newError("gaussblur")
 	}
-	defer C.g_free(C.gpointer(b))
 
-	_, err := w.Write(view(b, int(s)))
-	if err != nil {
-		return err
+	return newImage(out), nil
+}
+
+func (img *Image) ICCImport(intent int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.icc_import(
+		img.vi,
+		&out,
+		C.int(intent),
+	)
+
+	if status != 0 {
+		return nil, newError("icc_import")
 	}
 
-	return nil
+	return newImage(out), nil
 }
 
-func (img *Image) EncodeTIFF(w io.Writer) error {
-	var b unsafe.Pointer
-	var s C.size_t
+func (img *Image) ICCExport(intent int, depth int) (*Image, error) {
+	defer runtime.KeepAlive(img)
 
-	status := C.tiffsave_buffer(
+	var out *C.VipsImage
+
+	status := C.icc_export(
 		img.vi,
-		&b,
-		&s,
+		&out,
+		C.int(intent),
+		C.int(depth),
 	)
 
 	if status != 0 {
-		return errors.New(getError("tiffsave_buffer"))
+		return nil, newError("icc_export")
 	}
-	defer C.g_free(C.gpointer(b))
 
-	_, err := w.Write(view(b, int(s)))
-	if err != nil {
-		return err
+	return newImage(out), nil
+}
+
+func (img *Image) Autorot() (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.autorot(
+		img.vi,
+		&out,
+	)
+
+	if status != 0 {
+		return nil, newError("autorot")
 	}
 
-	return nil
+	return newImage(out), nil
 }
 
-func (img *Image) EncodeWEBP(w io.Writer, quality int, loseless bool) error {
-	var b unsafe.Pointer
-	var s C.size_t
+// Composite places overlay over the image at the given position using the "over" blend mode
+func (img *Image) Composite(overlay *Image, x int, y int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+	defer runtime.KeepAlive(overlay)
+
+	return img.CompositeBlend(overlay, BLEND_MODE_OVER, x, y)
+}
 
-	status := C.webpsave_buffer(
+// CompositeBlend composites overlay with the image at the given position, mode is one of the BLEND_MODE_* constants
+func (img *Image) CompositeBlend(overlay *Image, mode int, x int, y int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+	defer runtime.KeepAlive(overlay)
+
+	var out *C.VipsImage
+
+	status := C.composite(
 		img.vi,
-		&b,
-		&s,
-		C.int(quality),
-		C.int(btoi(loseless)),
+		overlay.vi,
+		&out,
+		C.int(mode),
+		C.int(x),
+		C.int(y),
 	)
 
 	if status != 0 {
-		return errors.New(getError("webpsave_buffer"))
+		return nil, newError("composite")
 	}
-	defer C.g_free(C.gpointer(b))
 
-	_, err := w.Write(view(b, int(s)))
-	if err != nil {
-		return err
+	return newImage(out), nil
+}
+
+// SvgLoad renders SVG document into the image in memory
+func SvgLoad(data []byte) (*Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("svgload_buffer: empty document")
 	}
 
-	return nil
+	var out *C.VipsImage
+
+	status := C.svgload_buffer(
+		unsafe.Pointer(&data[0]),
+		C.size_t(len(data)),
+		&out,
+	)
+
+	if status != 0 {
+		return nil, newError("svgload_buffer")
+	}
+
+	return newImage(out), nil
 }
 
-func (img *Image) Resize(xscale float64, yscale float64) (*Image, error) {
+// Black returns black image of the given size
+func Black(width int, height int, bands int) (*Image, error) {
 	var out *C.VipsImage
 
-	status := C.resize(
+	status := C.black(
+		&out,
+		C.int(width),
+		C.int(height),
+		C.int(bands),
+	)
+
+	if status != 0 {
+		return nil, newError("black")
+	}
+
+	return newImage(out), nil
+}
+
+// Flatten removes alpha channel blending the image with background,
+// background should have either one element or one element per band without alpha
+func (img *Image) Flatten(background []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(background) == 0 {
+		return nil, errors.New("flatten: background should be non-empty")
+	}
+
+	var out *C.VipsImage
+
+	status := C.flatten(
 		img.vi,
 		&out,
-		C.double(xscale),
-		C.double(yscale),
+		(*C.double)(unsafe.Pointer(&background[0])),
+		C.int(len(background)),
 	)
 
 	if status != 0 {
-		return nil, errors.New(getError("resize"))
+		return nil, newError("flatten")
 	}
 
-	return &Image{vi: out}, nil
+	return newImage(out), nil
 }
 
-func (img *Image) ICCImport(intent int) (*Image, error) {
+// Getpoint returns values of all bands of the pixel
+func (img *Image) Getpoint(x int, y int) ([]float64, error) {
+	defer runtime.KeepAlive(img)
+
+	var vector *C.double
+	var n C.int
+
+	status := C.getpoint(
+		img.vi,
+		&vector,
+		&n,
+		C.int(x),
+		C.int(y),
+	)
+
+	if status != 0 {
+		return nil, newError("getpoint")
+	}
+	defer C.g_free(C.gpointer(vector))
+
+	values := (*[1 << 28]C.double)(unsafe.Pointer(vector))[:n:n]
+
+	result := make([]float64, int(n))
+	for i, v := range values {
+		result[i] = float64(v)
+	}
+
+	return result, nil
+}
+
+// Text renders text into a one band mask image, font is a Pango font description like "sans 24"
+func Text(text string, font string, dpi int) (*Image, error) {
+	cText := C.CString(text)
+	defer C.free(unsafe.Pointer(cText))
+
+	cFont := C.CString(font)
+	defer C.free(unsafe.Pointer(cFont))
+
 	var out *C.VipsImage
 
-	status := C.icc_import(
+	status := C.text(
+		&out,
+		cText,
+		cFont,
+		C.int(dpi),
+	)
+
+	if status != 0 {
+		return nil, newError("text")
+	}
+
+	return newImage(out), nil
+}
+
+// Linear calculates a * in + b for every band, a and b should have either one element or one element per band
+func (img *Image) Linear(a []float64, b []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(a) == 0 || len(a) != len(b) {
+		return nil, errors.New("linear: a and b should be non-empty and have the same length")
+	}
+
+	var out *C.VipsImage
+
+	status := C.linear(
 		img.vi,
 		&out,
-		C.int(intent),
+		(*C.double)(unsafe.Pointer(&a[0])),
+		(*C.double)(unsafe.Pointer(&b[0])),
+		C.int(len(a)),
 	)
 
 	if status != 0 {
-		return nil, errors.New(getError("icc_import"))
+		return nil, newError("linear")
 	}
 
-	return &Image{vi: out}, nil
+	return newImage(out), nil
 }
 
-func (img *Image) ICCExport(intent int, depth int) (*Image, error) {
+// PowConst raises every band to the power, c should have either one element or one element per band
+func (img *Image) PowConst(c []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(c) == 0 {
+		return nil, errors.New("pow_const: c should be non-empty")
+	}
+
 	var out *C.VipsImage
 
-	status := C.icc_export(
+	status := C.pow_const(
 		img.vi,
 		&out,
-		C.int(intent),
-		C.int(depth),
+		(*C.double)(unsafe.Pointer(&c[0])),
+		C.int(len(c)),
 	)
 
 	if status != 0 {
-		return nil, errors.New(getError("icc_export"))
+		return nil, newError("pow_const")
 	}
 
-	return &Image{vi: out}, nil
+	return newImage(out), nil
 }
 
-func (img *Image) Autorot() (*Image, error) {
+// Cast converts image to the given band format
+func (img *Image) Cast(format int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
 	var out *C.VipsImage
 
-	status := C.autorot(
+	status := C.cast(
 		img.vi,
 		&out,
+		C.int(format),
 	)
 
 	if status != 0 {
-		return nil, errors.New(getError("autorot"))
+		return nil, newError("cast")
 	}
 
-	return &Image{vi: out}, nil
+	return newImage(out), nil
 }
 
+// ExtractBand returns n bands of the image starting from the given one
+func (img *Image) ExtractBand(band int, n int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.extract_band(
+		img.vi,
+		&out,
+		C.int(band),
+		C.int(n),
+	)
+
+	if status != 0 {
+		return nil, newError("extract_band")
+	}
+
+	return newImage(out), nil
+}
+
+// BandJoin appends bands of other image to the bands of the image
+func (img *Image) BandJoin(other *Image) (*Image, error) {
+	defer runtime.KeepAlive(img)
+	defer runtime.KeepAlive(other)
+
+	var out *C.VipsImage
+
+	status := C.bandjoin(
+		img.vi,
+		other.vi,
+		&out,
+	)
+
+	if status != 0 {
+		return nil, newError("bandjoin")
+	}
+
+	return newImage(out), nil
+}
+
+// BandJoinConst appends constant band to the image
+func (img *Image) BandJoinConst(c float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.bandjoin_const(
+		img.vi,
+		&out,
+		C.double(c),
+	)
+
+	if status != 0 {
+		return nil, newError("bandjoin_const")
+	}
+
+	return newImage(out), nil
+}
+
+// CopyWithInterpretation returns copy of the image with changed interpretation, pixels are not modified
+func (img *Image) CopyWithInterpretation(interpretation int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.copy_interpretation(
+		img.vi,
+		&out,
+		C.int(interpretation),
+	)
+
+	if status != 0 {
+		return nil, newError("copy_interpretation")
+	}
+
+	return newImage(out), nil
+}
+
+// NewFromImage returns image with the same size and format as the image and each band set to the constant
+func (img *Image) NewFromImage(c []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(c) == 0 {
+		return nil, errors.New("new_from_image: at least one band is required")
+	}
+
+	vi := C.vips_image_new_from_image(
+		img.vi,
+		(*C.double)(unsafe.Pointer(&c[0])),
+		C.int(len(c)),
+	)
+	if vi == nil {
+		return nil, newError("vips_image_new_from_image")
+	}
+
+	return newImage(vi), nil
+}
+
+// Rot rotates image by a multiple of 90 degrees clockwise, angle is one of the ANGLE_* constants
+func (img *Image) Rot(angle int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.rot(
+		img.vi,
+		&out,
+		C.int(angle),
+	)
+
+	if status != 0 {
+		return nil, newError("rot")
+	}
+
+	return newImage(out), nil
+}
+
+// Flip mirrors image, direction is one of the DIRECTION_* constants
+func (img *Image) Flip(direction int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.flip(
+		img.vi,
+		&out,
+		C.int(direction),
+	)
+
+	if status != 0 {
+		return nil, newError("flip")
+	}
+
+	return newImage(out), nil
+}
+
+// ExtractArea crops rectangle from the image
+func (img *Image) ExtractArea(left int, top int, width int, height int) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	var out *C.VipsImage
+
+	status := C.extract_area(
+		img.vi,
+		&out,
+		C.int(left),
+		C.int(top),
+		C.int(width),
+		C.int(height),
+	)
+
+	if status != 0 {
+		return nil, newError("extract_area")
+	}
+
+	return newImage(out), nil
+}
+
+// Similarity rotates image by an arbitrary angle in degrees clockwise,
+// new pixels are filled with background which should have either one element or one element per band
+func (img *Image) Similarity(angle float64, background []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(background) == 0 {
+		return nil, errors.New("similarity: background should be non-empty")
+	}
+
+	var out *C.VipsImage
+
+	status := C.similarity(
+		img.vi,
+		&out,
+		C.double(angle),
+		(*C.double)(unsafe.Pointer(&background[0])),
+		C.int(len(background)),
+	)
+
+	if status != 0 {
+		return nil, newError("similarity")
+	}
+
+	return newImage(out), nil
+}
+
+// FindTrim searches for the bounding box of the non-background area of the image,
+// background should have either one element or one element per band
+func (img *Image) FindTrim(threshold float64, background []float64) (int, int, int, int, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(background) == 0 {
+		return 0, 0, 0, 0, errors.New("find_trim: background should be non-empty")
+	}
+
+	var left, top, width, height C.int
+
+	status := C.find_trim(
+		img.vi,
+		&left,
+		&top,
+		&width,
+		&height,
+		C.double(threshold),
+		(*C.double)(unsafe.Pointer(&background[0])),
+		C.int(len(background)),
+	)
+
+	if status != 0 {
+		return 0, 0, 0, 0, newError("find_trim")
+	}
+
+	return int(left), int(top), int(width), int(height), nil
+}
+
+// Embed places image at the given position of the new canvas filled with background,
+// background should have either one element or one element per band
+func (img *Image) Embed(x int, y int, width int, height int, background []float64) (*Image, error) {
+	defer runtime.KeepAlive(img)
+
+	if len(background) == 0 {
+		return nil, errors.New("embed: background should be non-empty")
+	}
+
+	var out *C.VipsImage
+
+	status := C.embed(
+		img.vi,
+		&out,
+		C.int(x),
+		C.int(y),
+		C.int(width),
+		C.int(height),
+		(*C.double)(unsafe.Pointer(&background[0])),
+		C.int(len(background)),
+	)
+
+	if status != 0 {
+		return nil, newError("embed")
+	}
+
+	return newImage(out), nil
+}
+
+// LoadProfile returns a copy of the built-in or file ICC profile with given name
 func LoadProfile(name string) ([]byte, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
 	var profileBlob *C.VipsBlob
 	status := C.profile_load(
-		C.CString(name),
+		cName,
 		&profileBlob,
 	)
 
 	if status != 0 {
-		return nil, errors.New(getError("profile_load"))
+		return nil, newError("profile_load")
+	}
+
+	// Profile "none" has no blob
+	if profileBlob == nil {
+		return nil, nil
 	}
+	defer C.vips_area_unref((*C.VipsArea)(unsafe.Pointer(profileBlob)))
 
 	var length C.size_t
 	ptr := C.vips_blob_get(
@@ -397,7 +1180,7 @@ func LoadProfile(name string) ([]byte, error) {
 		&length,
 	)
 
-	return view(ptr, int(length)), nil
+	return C.GoBytes(ptr, C.int(length)), nil
 }
 
 func btoi(b bool) int {
@@ -1,77 +1,210 @@
 #include <stdlib.h>
+#include <stdint.h>
+#include <string.h>
 #include <vips/vips.h>
 
-VipsImage* image_new_from_buffer(
-	const void *buf,
-	size_t len,
-	const char *option_string
+extern gint64 goSourceRead(uintptr_t handle, void *buf, gint64 length);
+extern gint64 goSourceSeek(uintptr_t handle, gint64 offset, int whence);
+extern gint64 goTargetWrite(uintptr_t handle, void *data, gint64 length);
+extern void goStreamRelease(uintptr_t handle);
+
+static gint64 source_read(
+	VipsSourceCustom *source,
+	void *buf,
+	gint64 length,
+	gpointer handle
+) {
+	return goSourceRead((uintptr_t) handle, buf, length);
+}
+
+static gint64 source_seek(
+	VipsSourceCustom *source,
+	gint64 offset,
+	int whence,
+	gpointer handle
+) {
+	return goSourceSeek((uintptr_t) handle, offset, whence);
+}
+
+static gint64 target_write(
+	VipsTargetCustom *target,
+	const void *data,
+	gint64 length,
+	gpointer handle
+) {
+	return goTargetWrite((uintptr_t) handle, (void *) data, length);
+}
+
+static void stream_release(
+	gpointer handle,
+	GObject *object
+) {
+	goStreamRelease((uintptr_t) handle);
+}
+
+VipsImage* image_new_from_file(
+	const char *filename,
+	int access,
+	int fail_on
 ) {
-	return vips_image_new_from_buffer(
-		buf,
-		len,
+	return vips_image_new_from_file(
+		filename,
+		"access", access,
+		"fail_on", fail_on,
+		NULL
+	);
+}
+
+// Loaders of JPEG and WebP can decode the image at lower resolution,
+// factor which was applied is returned in applied_shrink
+VipsImage* image_new_from_file_shrink(
+	const char *filename,
+	int access,
+	int shrink,
+	int fail_on,
+	int *applied_shrink
+) {
+	const char *loader = vips_foreign_find_load(filename);
+	if (loader == NULL) {
+		return NULL;
+	}
+
+	*applied_shrink = 1;
+
+	if (shrink > 1 && strstr(loader, "Jpeg") != NULL) {
+		*applied_shrink = shrink;
+
+		return vips_image_new_from_file(
+			filename,
+			"access", access,
+			"fail_on", fail_on,
+			"shrink", shrink,
+			NULL
+		);
+	}
+
+	if (shrink > 1 && strstr(loader, "Webp") != NULL) {
+		*applied_shrink = shrink;
+
+		return vips_image_new_from_file(
+			filename,
+			"access", access,
+			"fail_on", fail_on,
+			"scale", 1.0 / shrink,
+			NULL
+		);
+	}
+
+	return vips_image_new_from_file(
+		filename,
+		"access", access,
+		"fail_on", fail_on,
+		NULL
+	);
+}
+
+// Source reads from the Go reader and is alive while the image needs it,
+// the handle is released when the source is finalized
+VipsImage* image_new_from_stream(
+	uintptr_t handle,
+	int seekable,
+	const char *option_string,
+	int fail_on
+) {
+	VipsSourceCustom *source = vips_source_custom_new();
+
+	g_signal_connect(source, "read", G_CALLBACK(source_read), (gpointer) handle);
+	if (seekable) {
+		g_signal_connect(source, "seek", G_CALLBACK(source_seek), (gpointer) handle);
+	}
+	g_object_weak_ref(G_OBJECT(source), stream_release, (gpointer) handle);
+
+	VipsImage *out = vips_image_new_from_source(
+		VIPS_SOURCE(source),
 		option_string,
+		"fail_on", fail_on,
+		NULL
+	);
+
+	g_object_unref(source);
+
+	return out;
+}
+
+VipsTarget* target_new(
+	uintptr_t handle
+) {
+	VipsTargetCustom *target = vips_target_custom_new();
+
+	g_signal_connect(target, "write", G_CALLBACK(target_write), (gpointer) handle);
+	g_object_weak_ref(G_OBJECT(target), stream_release, (gpointer) handle);
+
+	return VIPS_TARGET(target);
+}
+
+int write_to_target(
+	VipsImage *in,
+	VipsTarget *target,
+	const char *suffix
+) {
+	return vips_image_write_to_target(
+		in,
+		suffix,
+		target,
 		NULL
 	);
 }
 
-int jpegsave_buffer(
+int jpegsave_target(
 	VipsImage *in,
-	void **buf,
-	size_t *size,
+	VipsTarget *target,
 	int quality
 ) {
-	return vips_jpegsave_buffer(
+	return vips_jpegsave_target(
 		in,
-		buf,
-		size,
+		target,
 		"Q", quality,
 		"optimize_coding", TRUE,
 		NULL
 	);
 }
 
-int pngsave_buffer(
+int pngsave_target(
 	VipsImage *in,
-	void **buf,
-	size_t *size,
+	VipsTarget *target,
 	int compression
 ) {
-	return vips_pngsave_buffer(
+	return vips_pngsave_target(
 		in,
-		buf,
-		size,
+		target,
 		"compression", compression,
 		"filter", VIPS_FOREIGN_PNG_FILTER_NONE,
 		NULL
 	);
 }
 
-int webpsave_buffer(
+int webpsave_target(
 	VipsImage *in,
-	void **buf,
-	size_t *size,
+	VipsTarget *target,
 	int quality,
 	int loseless
 ) {
-	return vips_webpsave_buffer(
+	return vips_webpsave_target(
 		in,
-		buf,
-		size,
+		target,
 		"Q", quality,
 		"loseless", loseless,
 		NULL
 	);
 }
 
-int tiffsave_buffer(
+int tiffsave_target(
 	VipsImage *in,
-	void **buf,
-	size_t *size
+	VipsTarget *target
 ) {
-	return vips_tiffsave_buffer(
+	return vips_tiffsave_target(
 		in,
-		buf,
-		size,
+		target,
 		NULL
 	);
 }
@@ -129,6 +262,26 @@ int copy(
 	return vips_copy(in, out, NULL);
 }
 
+int copy_memory(
+	VipsImage *in,
+	VipsImage **out
+) {
+	*out = vips_image_copy_memory(in);
+
+	if (*out == NULL) {
+		return -1;
+	}
+
+	return 0;
+}
+
+int avg(
+	VipsImage *in,
+	double *out
+) {
+	return vips_avg(in, out, NULL);
+}
+
 int profile_load(
 	const char *name,
     VipsBlob **profile
@@ -159,3 +312,308 @@ int image_remove(
 ) {
 	return (int)vips_image_remove(image, name);
 }
+
+int composite(
+	VipsImage *base,
+	VipsImage *overlay,
+	VipsImage **out,
+	int mode,
+	int x,
+	int y
+) {
+	return vips_composite2(
+		base,
+		overlay,
+		out,
+		mode,
+		"x", x,
+		"y", y,
+		"compositing_space", base->Type,
+		NULL
+	);
+}
+
+int text(
+	VipsImage **out,
+	const char *text,
+	const char *font,
+	int dpi
+) {
+	return vips_text(
+		out,
+		text,
+		"font", font,
+		"dpi", dpi,
+		NULL
+	);
+}
+
+int linear(
+	VipsImage *in,
+	VipsImage **out,
+	const double *a,
+	const double *b,
+	int n
+) {
+	return vips_linear(in, out, a, b, n, NULL);
+}
+
+int cast(
+	VipsImage *in,
+	VipsImage **out,
+	int format
+) {
+	return vips_cast(in, out, format, NULL);
+}
+
+int extract_band(
+	VipsImage *in,
+	VipsImage **out,
+	int band,
+	int n
+) {
+	return vips_extract_band(in, out, band, "n", n, NULL);
+}
+
+int bandjoin(
+	VipsImage *in1,
+	VipsImage *in2,
+	VipsImage **out
+) {
+	return vips_bandjoin2(in1, in2, out, NULL);
+}
+
+int bandjoin_const(
+	VipsImage *in,
+	VipsImage **out,
+	double c
+) {
+	return vips_bandjoin_const1(in, out, c, NULL);
+}
+
+int copy_interpretation(
+	VipsImage *in,
+	VipsImage **out,
+	int interpretation
+) {
+	return vips_copy(in, out, "interpretation", interpretation, NULL);
+}
+
+int rot(
+	VipsImage *in,
+	VipsImage **out,
+	int angle
+) {
+	return vips_rot(in, out, angle, NULL);
+}
+
+int flip(
+	VipsImage *in,
+	VipsImage **out,
+	int direction
+) {
+	return vips_flip(in, out, direction, NULL);
+}
+
+int extract_area(
+	VipsImage *in,
+	VipsImage **out,
+	int left,
+	int top,
+	int width,
+	int height
+) {
+	return vips_extract_area(in, out, left, top, width, height, NULL);
+}
+
+int similarity(
+	VipsImage *in,
+	VipsImage **out,
+	double angle,
+	const double *background,
+	int n
+) {
+	VipsArrayDouble *bg = vips_array_double_new(background, n);
+
+	int status = vips_similarity(
+		in,
+		out,
+		"angle", angle,
+		"background", bg,
+		NULL
+	);
+
+	vips_area_unref(VIPS_AREA(bg));
+
+	return status;
+}
+
+int find_trim(
+	VipsImage *in,
+	int *left,
+	int *top,
+	int *width,
+	int *height,
+	double threshold,
+	const double *background,
+	int n
+) {
+	VipsArrayDouble *bg = vips_array_double_new(background, n);
+
+	int status = vips_find_trim(
+		in,
+		left,
+		top,
+		width,
+		height,
+		"threshold", threshold,
+		"background", bg,
+		NULL
+	);
+
+	vips_area_unref(VIPS_AREA(bg));
+
+	return status;
+}
+
+int embed(
+	VipsImage *in,
+	VipsImage **out,
+	int x,
+	int y,
+	int width,
+	int height,
+	const double *background,
+	int n
+) {
+	VipsArrayDouble *bg = vips_array_double_new(background, n);
+
+	int status = vips_embed(
+		in,
+		out,
+		x,
+		y,
+		width,
+		height,
+		"extend", VIPS_EXTEND_BACKGROUND,
+		"background", bg,
+		NULL
+	);
+
+	vips_area_unref(VIPS_AREA(bg));
+
+	return status;
+}
+
+int pow_const(
+	VipsImage *in,
+	VipsImage **out,
+	const double *c,
+	int n
+) {
+	return vips_math2_const(in, out, VIPS_OPERATION_MATH2_POW, c, n, NULL);
+}
+
+int resize_kernel(
+	VipsImage *in,
+	VipsImage **out,
+	double xscale,
+	double yscale,
+	int kernel
+) {
+	return vips_resize(
+		in,
+		out,
+		xscale,
+		"vscale", yscale,
+		"kernel", kernel,
+		NULL
+	);
+}
+
+int gaussblur(
+	VipsImage *in,
+	VipsImage **out,
+	double sigma
+) {
+	return vips_gaussblur(in, out, sigma, NULL);
+}
+
+int svgload_buffer(
+	void *buf,
+	size_t len,
+	VipsImage **out
+) {
+	VipsImage *svg;
+
+	if (vips_svgload_buffer(buf, len, &svg, NULL) != 0) {
+		return -1;
+	}
+
+	// Render into memory, so the buffer is not referenced after return
+	*out = vips_image_copy_memory(svg);
+	g_object_unref(svg);
+
+	if (*out == NULL) {
+		return -1;
+	}
+
+	return 0;
+}
+
+int flatten(
+	VipsImage *in,
+	VipsImage **out,
+	const double *background,
+	int n
+) {
+	VipsArrayDouble *bg = vips_array_double_new(background, n);
+
+	int status = vips_flatten(
+		in,
+		out,
+		"background", bg,
+		NULL
+	);
+
+	vips_area_unref(VIPS_AREA(bg));
+
+	return status;
+}
+
+int black(
+	VipsImage **out,
+	int width,
+	int height,
+	int bands
+) {
+	return vips_black(out, width, height, "bands", bands, NULL);
+}
+
+int getpoint(
+	VipsImage *in,
+	double **vector,
+	int *n,
+	int x,
+	int y
+) {
+	return vips_getpoint(in, vector, n, x, y, NULL);
+}
+
+static void *count_object(
+	VipsObject *object,
+	void *a,
+	void *b
+) {
+	(*(int *) a)++;
+
+	return NULL;
+}
+
+int live_objects() {
+	int n = 0;
+
+	vips_object_map((VipsSListMap2Fn) count_object, &n, NULL);
+
+	return n;
+}
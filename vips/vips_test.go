@@ -0,0 +1,256 @@
+package vips
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// iterations of the leak tests, leaks of a few bytes per call become megabytes
+const iterations = 20000
+
+// warmup is the number of runs before counters are compared, it is larger than the operation cache of vips
+const warmup = 500
+
+// maxRSSGrowth is how much resident memory can grow during a leak test without being a leak
+const maxRSSGrowth = 16 << 20
+
+func TestMain(m *testing.M) {
+	Init("sharpei-test")
+	code := m.Run()
+	Shutdown()
+	os.Exit(code)
+}
+
+// rss returns resident memory of the process, zero if it is unknown
+func rss() int64 {
+	content, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) < 2 {
+		return 0
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return pages * int64(os.Getpagesize())
+}
+
+// checkFlat runs f many times and fails if images, objects, pixel buffers or resident memory grow
+func checkFlat(t *testing.T, n int, f func()) {
+	t.Helper()
+
+	// First runs fill the operation cache of vips, it is not a leak
+	for i := 0; i < warmup; i++ {
+		f()
+	}
+	runtime.GC()
+
+	before, rssBefore := Stats(), rss()
+
+	for i := 0; i < n; i++ {
+		f()
+	}
+
+	runtime.GC()
+
+	after, rssAfter := Stats(), rss()
+
+	if after.Images != before.Images {
+		t.Errorf("live images: %d before, %d after", before.Images, after.Images)
+	}
+
+	if after.Objects != before.Objects {
+		t.Errorf("live objects: %d before, %d after", before.Objects, after.Objects)
+	}
+
+	if after.Allocs != before.Allocs || after.Mem != before.Mem {
+		t.Errorf("pixel buffers: %d allocations of %d bytes before, %d allocations of %d bytes after",
+			before.Allocs, before.Mem, after.Allocs, after.Mem)
+	}
+
+	if after.Files != before.Files {
+		t.Errorf("open files: %d before, %d after", before.Files, after.Files)
+	}
+
+	if rssBefore > 0 && rssAfter-rssBefore > maxRSSGrowth {
+		t.Errorf("resident memory grew by %d bytes", rssAfter-rssBefore)
+	}
+}
+
+func black(t *testing.T) *Image {
+	t.Helper()
+
+	img, err := Black(64, 64, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+}
+
+// pngImage returns image decoded from PNG, it has string properties set by the loader
+func pngImage(t *testing.T) *Image {
+	t.Helper()
+
+	img := black(t)
+	defer img.Destroy()
+
+	buf := &bytes.Buffer{}
+	if err := img.EncodePNG(buf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeStream(bytes.NewReader(buf.Bytes()), FAIL_ON_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestNewImage(t *testing.T) {
+	before := Stats().Images
+
+	img := black(t)
+	if got := Stats().Images; got != before+1 {
+		t.Fatalf("live images: got %d, want %d", got, before+1)
+	}
+
+	img.Destroy()
+	img.Destroy()
+
+	if got := Stats().Images; got != before {
+		t.Fatalf("live images after Destroy: got %d, want %d", got, before)
+	}
+}
+
+func TestCopyDoesNotLeak(t *testing.T) {
+	img := black(t)
+	defer img.Destroy()
+
+	checkFlat(t, iterations, func() {
+		copied, err := img.Copy()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inMemory, err := copied.CopyMemory()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inMemory.Destroy()
+		copied.Destroy()
+	})
+}
+
+func TestLoadProfileDoesNotLeak(t *testing.T) {
+	// CMYK profile is about half a megabyte, so a leaked blob is visible in resident memory
+	profile, err := LoadProfile("cmyk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(profile) == 0 {
+		t.Fatal("profile is empty")
+	}
+
+	checkFlat(t, 200, func() {
+		if _, err := LoadProfile("cmyk"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	none, err := LoadProfile("none")
+	if err != nil || none != nil {
+		t.Fatalf("profile none: got %d bytes and error %v, want nothing", len(none), err)
+	}
+}
+
+func TestPropertyStringDoesNotLeak(t *testing.T) {
+	img := pngImage(t)
+	defer img.Destroy()
+
+	loader := img.PropertyString("vips-loader")
+	if !strings.HasPrefix(loader, "png") {
+		t.Fatalf("vips-loader: got %q, want pngload", loader)
+	}
+
+	checkFlat(t, 50*iterations, func() {
+		if img.PropertyString("vips-loader") != loader {
+			t.Fatal("vips-loader has changed")
+		}
+	})
+}
+
+func TestErrorsDoNotAccumulate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharpei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "missing.png")
+
+	_, first := NewFromFile(path, ACCESS_SEQUENTIAL, FAIL_ON_NONE)
+	if first == nil {
+		t.Fatal("no error for a missing file")
+	}
+
+	checkFlat(t, iterations, func() {
+		_, err := NewFromFile(path, ACCESS_SEQUENTIAL, FAIL_ON_NONE)
+		if err == nil {
+			t.Fatal("no error for a missing file")
+		}
+
+		// Error buffer is cleared, so messages of previous errors are not repeated
+		if err.Error() != first.Error() {
+			t.Fatalf("error has changed: got %q, want %q", err.Error(), first.Error())
+		}
+	})
+}
+
+func TestDecodeErrorsDoNotLeak(t *testing.T) {
+	checkFlat(t, iterations, func() {
+		img, err := DecodeStream(bytes.NewReader([]byte("not an image")), FAIL_ON_NONE)
+		if err == nil {
+			img.Destroy()
+			t.Fatal("no error for garbage")
+		}
+	})
+}
+
+func TestFinalizers(t *testing.T) {
+	SetFinalizers(true)
+	defer SetFinalizers(false)
+
+	before := Stats().Images
+
+	for i := 0; i < 100; i++ {
+		_ = black(t)
+	}
+
+	// Finalizers run in their own goroutine after the collection
+	deadline := time.Now().Add(5 * time.Second)
+	for Stats().Images != before && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := Stats().Images; got != before {
+		t.Fatalf("live images: got %d, want %d", got, before)
+	}
+}
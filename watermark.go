@@ -0,0 +1,263 @@
+package sharpei
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/meownoid/sharpei/vips"
+	"github.com/pkg/errors"
+)
+
+var (
+	watermarkCache   = map[string][]byte{}
+	watermarkCacheMu sync.Mutex
+)
+
+func getWatermark(path string) ([]byte, error) {
+	watermarkCacheMu.Lock()
+	defer watermarkCacheMu.Unlock()
+
+	if data, ok := watermarkCache[path]; ok {
+		return data, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watermarkCache[path] = data
+	return data, nil
+}
+
+// renderWatermark returns watermark image with alpha channel in its original size
+func renderWatermark(cfg WatermarkConfig) (*vips.Image, error) {
+	if cfg.Image != "" {
+		data, err := getWatermark(cfg.Image)
+		if err != nil {
+			return nil, err
+		}
+
+		return vips.Decode(bytes.NewReader(data))
+	}
+
+	if cfg.Text == "" {
+		return nil, errors.New("watermark should have either image or text")
+	}
+
+	font := cfg.Font
+	if font == "" {
+		font = "sans"
+	}
+
+	size := cfg.Size
+	if size <= 0 {
+		size = 24
+	}
+
+	colorName := cfg.Color
+	if colorName == "" {
+		colorName = "white"
+	}
+
+	color, err := parseColor(colorName)
+	if err != nil {
+		return nil, err
+	}
+
+	// At 72 DPI font size in points equals size in pixels
+	mask, err := vips.Text(cfg.Text, fmt.Sprintf("%s %d", font, size), 72)
+	if err != nil {
+		return nil, err
+	}
+	defer mask.Destroy()
+
+	fill, err := mask.NewFromImage(color[:3])
+	if err != nil {
+		return nil, err
+	}
+	defer fill.Destroy()
+
+	alpha, err := mask.Linear([]float64{color[3] / 255}, []float64{0})
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Destroy()
+
+	alphaCast, err := alpha.Cast(vips.FORMAT_UCHAR)
+	if err != nil {
+		return nil, err
+	}
+	defer alphaCast.Destroy()
+
+	textImg, err := fill.BandJoin(alphaCast)
+	if err != nil {
+		return nil, err
+	}
+	defer textImg.Destroy()
+
+	return textImg.CopyWithInterpretation(vips.INTERPRETATION_sRGB)
+}
+
+// setOpacity returns copy of the image with alpha channel multiplied by opacity,
+// alpha channel is added if image has none
+func setOpacity(img *vips.Image, opacity float64) (*vips.Image, error) {
+	imgWithAlpha := img
+	if !img.HasAlpha() {
+		var err error
+		imgWithAlpha, err = img.BandJoinConst(255)
+		if err != nil {
+			return nil, err
+		}
+		defer imgWithAlpha.Destroy()
+	}
+
+	bands := imgWithAlpha.Bands()
+
+	color, err := imgWithAlpha.ExtractBand(0, bands-1)
+	if err != nil {
+		return nil, err
+	}
+	defer color.Destroy()
+
+	alpha, err := imgWithAlpha.ExtractBand(bands-1, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer alpha.Destroy()
+
+	alphaScaled, err := alpha.Linear([]float64{opacity}, []float64{0})
+	if err != nil {
+		return nil, err
+	}
+	defer alphaScaled.Destroy()
+
+	alphaCast, err := alphaScaled.Cast(imgWithAlpha.Format())
+	if err != nil {
+		return nil, err
+	}
+	defer alphaCast.Destroy()
+
+	return color.BandJoin(alphaCast)
+}
+
+// matchProfile converts overlay to the ICC profile of the base image, resizing it in the LAB PCS space,
+// so it is composited without colour shift
+func matchProfile(overlay *vips.Image, base *vips.Image, scale float64) (*vips.Image, error) {
+	outputProfile, err := base.PropertyBlob("icc-profile-data")
+	if err != nil {
+		// Base image is not colour managed, nothing to match
+		return overlay.Resize(scale, scale)
+	}
+
+	imgImported, _, err := importImage(overlay, "")
+	if err != nil {
+		return nil, err
+	}
+	defer imgImported.Destroy()
+
+	imgResized, err := imgImported.Resize(scale, scale)
+	if err != nil {
+		return nil, err
+	}
+	defer imgResized.Destroy()
+
+	return exportImage(imgResized, outputProfile)
+}
+
+// watermarkPosition returns position of the top left corner of the overlay
+func watermarkPosition(gravity string, margin int, width int, height int, overlayWidth int, overlayHeight int) (int, int, error) {
+	left := margin
+	right := width - overlayWidth - margin
+	top := margin
+	bottom := height - overlayHeight - margin
+	centerX := (width - overlayWidth) / 2
+	centerY := (height - overlayHeight) / 2
+
+	switch strings.ToLower(gravity) {
+	case "north-west", "top-left":
+		return left, top, nil
+	case "north", "top":
+		return centerX, top, nil
+	case "north-east", "top-right":
+		return right, top, nil
+	case "west", "left":
+		return left, centerY, nil
+	case "center", "centre":
+		return centerX, centerY, nil
+	case "east", "right":
+		return right, centerY, nil
+	case "south-west", "bottom-left":
+		return left, bottom, nil
+	case "south", "bottom":
+		return centerX, bottom, nil
+	case "", "south-east", "bottom-right":
+		return right, bottom, nil
+	}
+
+	return 0, 0, errors.Errorf("unsupported watermark gravity %s", gravity)
+}
+
+// ApplyWatermark composites watermark over the transformed image
+func ApplyWatermark(img *vips.Image, cfg WatermarkConfig) (*vips.Image, error) {
+	watermark, err := renderWatermark(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "watermark")
+	}
+	defer watermark.Destroy()
+
+	scale := 1.0
+	if cfg.Scale > 0 {
+		scale = cfg.Scale * float64(img.Width()) / float64(watermark.Width())
+	}
+
+	watermarkMatched, err := matchProfile(watermark, img, scale)
+	if err != nil {
+		return nil, errors.Wrap(err, "watermark")
+	}
+	defer watermarkMatched.Destroy()
+
+	opacity := cfg.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+
+	watermarkFinal, err := setOpacity(watermarkMatched, opacity)
+	if err != nil {
+		return nil, err
+	}
+	defer watermarkFinal.Destroy()
+
+	margin := cfg.Margin
+	if margin < 0 {
+		margin = 0
+	}
+
+	x, y, err := watermarkPosition(
+		cfg.Gravity,
+		margin,
+		img.Width(),
+		img.Height(),
+		watermarkFinal.Width(),
+		watermarkFinal.Height(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	imgComposited, err := img.Composite(watermarkFinal, x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	if img.HasAlpha() {
+		return imgComposited, nil
+	}
+	defer imgComposited.Destroy()
+
+	// Composite always adds alpha channel, drop it if the original image had none
+	return imgComposited.ExtractBand(0, img.Bands())
+}